@@ -0,0 +1,132 @@
+package chanrpc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+// what AsynCall does when the client has too many pending calls or the
+// channel of the server is full
+type Policy int
+
+const (
+	// fail the call at once
+	FailFast Policy = iota
+	// queue the call locally and send it when capacity frees
+	Queue
+	// block the caller until capacity frees or the timeout expires
+	Block
+)
+
+type Backpressure struct {
+	Policy   Policy
+	QueueLen int           // the bound of the local queue, for Queue
+	Timeout  time.Duration // for Block
+}
+
+type AsynStats struct {
+	Calls     uint64
+	Rejected  uint64
+	Queued    uint64 // total
+	QueueLen  int    // current
+	Blocked   uint64
+	BlockTime time.Duration // total
+}
+
+var ErrTooManyCalls = errors.New("too many calls")
+
+type asynCallInfo struct {
+	s       *Server
+	id      interface{}
+	args    []interface{}
+	cb      interface{}
+	n       int
+	exec    func(done func(ret interface{}, err error)) // ExtAsynCall
+	traceID string
+}
+
+// the default policy is FailFast
+func (c *Client) SetBackpressure(bp Backpressure) {
+	c.backpressure = bp
+}
+
+func (c *Client) Stats() AsynStats {
+	stats := c.stats
+	stats.QueueLen = c.backlog.Len()
+	return stats
+}
+
+func (c *Client) asynCall(ac *asynCallInfo) {
+	c.stats.Calls++
+	ac.traceID = log.TraceID()
+
+	// the queued calls go first
+	err := ErrTooManyCalls
+	if c.backlog.Len() == 0 {
+		err = c.trySend(ac, nil)
+		if err == nil {
+			return
+		}
+	}
+
+	switch c.backpressure.Policy {
+	case Queue:
+		if c.backlog.Len() < c.backpressure.QueueLen {
+			c.backlog.PushBack(ac)
+			c.stats.Queued++
+			return
+		}
+	case Block:
+		err = c.blockSend(ac)
+		if err == nil {
+			return
+		}
+	}
+
+	c.reject(ac, err)
+}
+
+func (c *Client) blockSend(ac *asynCallInfo) error {
+	c.stats.Blocked++
+	start := time.Now()
+	defer func() {
+		c.stats.BlockTime += time.Since(start)
+	}()
+
+	timer := time.NewTimer(c.backpressure.Timeout)
+	defer timer.Stop()
+
+	for {
+		err := c.trySend(ac, timer.C)
+		if err != ErrTooManyCalls {
+			return err
+		}
+
+		// the callbacks free the slots
+		select {
+		case ri := <-c.ChanAsynRet:
+			c.Cb(ri)
+		case <-timer.C:
+			return err
+		}
+	}
+}
+
+func (c *Client) reject(ac *asynCallInfo, err error) {
+	c.stats.Rejected++
+	execCb(&RetInfo{err: err, cb: ac.cb, traceID: ac.traceID})
+}
+
+// Flush sends the queued calls as long as there is capacity, it is called
+// by Cb and should be called periodically as the server frees capacity
+// silently
+func (c *Client) Flush() {
+	for e := c.backlog.Front(); e != nil; e = c.backlog.Front() {
+		if c.trySend(e.Value.(*asynCallInfo), nil) != nil {
+			return
+		}
+		c.backlog.Remove(e)
+	}
+}
@@ -1,9 +1,13 @@
 package chanrpc
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/rufeng18/tinyleaf/conf"
 	"github.com/rufeng18/tinyleaf/log"
@@ -18,15 +22,34 @@ type Server struct {
 	// func(args []interface{})
 	// func(args []interface{}) interface{}
 	// func(args []interface{}) []interface{}
-	functions map[interface{}]interface{}
-	ChanCall  chan *CallInfo
+	// or any function with concrete arguments (see typedFunc)
+	functions    map[interface{}]interface{}
+	interceptors []Interceptor
+	ChanCall     chan *CallInfo
+	Name         string // the servers listed by Servers need a name
+
+	// the lanes above PriorityNormal and id -> priority
+	lanes      [numPriorities]chan *CallInfo
+	priorities map[interface{}]Priority
+
+	// dropped Go calls
+	deadLetterHandler DeadLetterHandler
+	deadLetters       DeadLetterStats
+
+	// id -> stats
+	mutexStats sync.Mutex
+	stats      map[interface{}]*FuncStats
 }
 
 type CallInfo struct {
-	f       interface{}
-	args    []interface{}
-	chanRet chan *RetInfo
-	cb      interface{}
+	id       interface{}
+	f        interface{}
+	args     []interface{}
+	chanRet  chan *RetInfo
+	cb       interface{}
+	time     time.Time
+	priority Priority
+	traceID  string
 }
 
 type RetInfo struct {
@@ -39,7 +62,8 @@ type RetInfo struct {
 	// func(err error)
 	// func(ret interface{}, err error)
 	// func(ret []interface{}, err error)
-	cb interface{}
+	cb      interface{}
+	traceID string
 }
 
 type Client struct {
@@ -47,12 +71,17 @@ type Client struct {
 	chanSyncRet     chan *RetInfo
 	ChanAsynRet     chan *RetInfo
 	pendingAsynCall int
+	backpressure    Backpressure
+	backlog         *list.List
+	stats           AsynStats
 }
 
 func NewServer(l int) *Server {
 	s := new(Server)
 	s.functions = make(map[interface{}]interface{})
 	s.ChanCall = make(chan *CallInfo, l)
+	s.priorities = make(map[interface{}]Priority)
+	s.stats = make(map[interface{}]*FuncStats)
 	return s
 }
 
@@ -71,7 +100,11 @@ func (s *Server) Register(id interface{}, f interface{}) {
 	case func([]interface{}) interface{}:
 	case func([]interface{}) []interface{}:
 	default:
-		panic(fmt.Sprintf("function id %v: definition of function is invalid", id))
+		tf, err := newTypedFunc(f)
+		if err != nil {
+			panic(fmt.Sprintf("function id %v: definition of function is invalid: %v", id, err))
+		}
+		f = tf
 	}
 
 	if _, ok := s.functions[id]; ok {
@@ -93,6 +126,7 @@ func (s *Server) ret(ci *CallInfo, ri *RetInfo) (err error) {
 	}()
 
 	ri.cb = ci.cb
+	ri.traceID = ci.traceID
 	ci.chanRet <- ri
 	return
 }
@@ -112,24 +146,44 @@ func (s *Server) exec(ci *CallInfo) (err error) {
 		}
 	}()
 
-	// execute
-	switch ci.f.(type) {
+	ret, callErr := s.invoke(ci)
+	if ci.chanRet == nil {
+		// nobody else sees the error
+		return callErr
+	}
+	return s.ret(ci, &RetInfo{ret: ret, err: callErr})
+}
+
+func call(f interface{}, args []interface{}) (interface{}, error) {
+	switch f.(type) {
 	case func([]interface{}):
-		ci.f.(func([]interface{}))(ci.args)
-		return s.ret(ci, &RetInfo{})
+		f.(func([]interface{}))(args)
+		return nil, nil
 	case func([]interface{}) interface{}:
-		ret := ci.f.(func([]interface{}) interface{})(ci.args)
-		return s.ret(ci, &RetInfo{ret: ret})
+		return f.(func([]interface{}) interface{})(args), nil
 	case func([]interface{}) []interface{}:
-		ret := ci.f.(func([]interface{}) []interface{})(ci.args)
-		return s.ret(ci, &RetInfo{ret: ret})
+		return f.(func([]interface{}) []interface{})(args), nil
+	case *typedFunc:
+		tf := f.(*typedFunc)
+		in, err := tf.values(args)
+		if err != nil {
+			return nil, err
+		}
+		return tf.call(in)
 	}
 
 	panic("bug")
 }
 
 func (s *Server) Exec(ci *CallInfo) {
+	if ci.traceID != "" {
+		prev := log.SetTraceID(ci.traceID)
+		defer log.SetTraceID(prev)
+	}
+
+	start := time.Now()
 	err := s.exec(ci)
+	s.record(ci, start)
 	if err != nil {
 		log.Error("%v", err)
 	}
@@ -137,19 +191,50 @@ func (s *Server) Exec(ci *CallInfo) {
 
 // goroutine safe
 func (s *Server) Go(id interface{}, args ...interface{}) {
+	s.goCall(id, args, s.priorities[id], true)
+}
+
+// TryGo is Go without blocking, the error tells why the call is dropped:
+// ErrNotRegistered, ErrClosed or ErrFull
+// goroutine safe
+func (s *Server) TryGo(id interface{}, args ...interface{}) error {
+	return s.goCall(id, args, s.priorities[id], false)
+}
+
+func (s *Server) goCall(id interface{}, args []interface{}, p Priority, block bool) (err error) {
 	f := s.functions[id]
 	if f == nil {
-		return
+		s.deadLetter(id, args, ErrNotRegistered)
+		return ErrNotRegistered
 	}
 
 	defer func() {
-		recover()
+		if r := recover(); r != nil {
+			err = ErrClosed
+			s.deadLetter(id, args, err)
+		}
 	}()
 
-	s.ChanCall <- &CallInfo{
-		f:    f,
-		args: args,
+	ci := &CallInfo{
+		id:       id,
+		f:        f,
+		args:     args,
+		time:     time.Now(),
+		priority: p,
+		traceID:  log.TraceID(),
+	}
+	if block {
+		s.lane(p) <- ci
+		return
+	}
+
+	select {
+	case s.lane(p) <- ci:
+	default:
+		err = ErrFull
+		s.deadLetter(id, args, err)
 	}
+	return
 }
 
 // goroutine safe
@@ -167,13 +252,40 @@ func (s *Server) CallN(id interface{}, args ...interface{}) ([]interface{}, erro
 	return s.Open(0).CallN(id, args...)
 }
 
+// goroutine safe
+func (s *Server) Call0Context(ctx context.Context, id interface{}, args ...interface{}) error {
+	return s.Open(0).Call0Context(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) Call1Context(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	return s.Open(0).Call1Context(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) CallNContext(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
+	return s.Open(0).CallNContext(ctx, id, args...)
+}
+
 func (s *Server) Close() {
-	close(s.ChanCall)
+	unlistServer(s)
 
-	for ci := range s.ChanCall {
-		s.ret(ci, &RetInfo{
-			err: errors.New("chanrpc server closed"),
-		})
+	for p := numPriorities - 1; p >= PriorityNormal; p-- {
+		lane := s.Lane(p)
+		if lane == nil {
+			continue
+		}
+		close(lane)
+
+		for ci := range lane {
+			if ci.chanRet == nil {
+				s.deadLetter(ci.id, ci.args, ErrClosed)
+				continue
+			}
+			s.ret(ci, &RetInfo{
+				err: ErrClosed,
+			})
+		}
 	}
 }
 
@@ -188,6 +300,7 @@ func NewClient(l int) *Client {
 	c := new(Client)
 	c.chanSyncRet = make(chan *RetInfo, 1)
 	c.ChanAsynRet = make(chan *RetInfo, l)
+	c.backlog = list.New()
 	return c
 }
 
@@ -195,47 +308,104 @@ func (c *Client) Attach(s *Server) {
 	c.s = s
 }
 
-func (c *Client) call(ci *CallInfo, block bool) (err error) {
+// wait nil means not to wait
+func (s *Server) send(ci *CallInfo, wait <-chan time.Time) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
 
-	if block {
-		c.s.ChanCall <- ci
-	} else {
+	if wait == nil {
 		select {
-		case c.s.ChanCall <- ci:
+		case s.lane(ci.priority) <- ci:
 		default:
-			err = errors.New("chanrpc channel full")
+			err = ErrFull
+		}
+	} else {
+		select {
+		case s.lane(ci.priority) <- ci:
+		case <-wait:
+			err = ErrFull
 		}
 	}
 	return
 }
 
-func (c *Client) f(id interface{}, n int) (f interface{}, err error) {
-	if c.s == nil {
+func (c *Client) callContext(ctx context.Context, ci *CallInfo) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+
+	select {
+	case c.s.lane(ci.priority) <- ci:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+func (c *Client) syncCall(ctx context.Context, id interface{}, n int, args []interface{}) (*RetInfo, error) {
+	f, err := c.f(id, n)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.callContext(ctx, &CallInfo{
+		id:       id,
+		f:        f,
+		args:     args,
+		chanRet:  c.chanSyncRet,
+		time:     time.Now(),
+		priority: c.s.priorities[id],
+		traceID:  log.TraceID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case ri := <-c.chanSyncRet:
+		return ri, nil
+	case <-ctx.Done():
+		// the late reply goes to the abandoned channel
+		c.chanSyncRet = make(chan *RetInfo, 1)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) f(id interface{}, n int) (interface{}, error) {
+	return getFunc(c.s, id, n)
+}
+
+func getFunc(s *Server, id interface{}, n int) (f interface{}, err error) {
+	if s == nil {
 		err = errors.New("server not attached")
 		return
 	}
 
-	f = c.s.functions[id]
+	f = s.functions[id]
 	if f == nil {
 		err = fmt.Errorf("function id %v: function not registered", id)
 		return
 	}
 
 	var ok bool
-	switch n {
-	case 0:
-		_, ok = f.(func([]interface{}))
-	case 1:
-		_, ok = f.(func([]interface{}) interface{})
-	case 2:
-		_, ok = f.(func([]interface{}) []interface{})
-	default:
-		panic("bug")
+	if tf, isTyped := f.(*typedFunc); isTyped {
+		ok = tf.n == n
+	} else {
+		switch n {
+		case 0:
+			_, ok = f.(func([]interface{}))
+		case 1:
+			_, ok = f.(func([]interface{}) interface{})
+		case 2:
+			_, ok = f.(func([]interface{}) []interface{})
+		default:
+			panic("bug")
+		}
 	}
 
 	if !ok {
@@ -245,79 +415,79 @@ func (c *Client) f(id interface{}, n int) (f interface{}, err error) {
 }
 
 func (c *Client) Call0(id interface{}, args ...interface{}) error {
-	f, err := c.f(id, 0)
-	if err != nil {
-		return err
-	}
+	return c.Call0Context(context.Background(), id, args...)
+}
 
-	err = c.call(&CallInfo{
-		f:       f,
-		args:    args,
-		chanRet: c.chanSyncRet,
-	}, true)
-	if err != nil {
-		return err
-	}
+func (c *Client) Call1(id interface{}, args ...interface{}) (interface{}, error) {
+	return c.Call1Context(context.Background(), id, args...)
+}
 
-	ri := <-c.chanSyncRet
-	return ri.err
+func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, error) {
+	return c.CallNContext(context.Background(), id, args...)
 }
 
-func (c *Client) Call1(id interface{}, args ...interface{}) (interface{}, error) {
-	f, err := c.f(id, 1)
+// the call returns ctx.Err() if ctx is done before the function returns
+func (c *Client) Call0Context(ctx context.Context, id interface{}, args ...interface{}) error {
+	ri, err := c.syncCall(ctx, id, 0, args)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return ri.err
+}
 
-	err = c.call(&CallInfo{
-		f:       f,
-		args:    args,
-		chanRet: c.chanSyncRet,
-	}, true)
+func (c *Client) Call1Context(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	ri, err := c.syncCall(ctx, id, 1, args)
 	if err != nil {
 		return nil, err
 	}
-
-	ri := <-c.chanSyncRet
 	return ri.ret, ri.err
 }
 
-func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, error) {
-	f, err := c.f(id, 2)
+func (c *Client) CallNContext(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
+	ri, err := c.syncCall(ctx, id, 2, args)
 	if err != nil {
 		return nil, err
 	}
+	return assert(ri.ret), ri.err
+}
 
-	err = c.call(&CallInfo{
-		f:       f,
-		args:    args,
-		chanRet: c.chanSyncRet,
-	}, true)
-	if err != nil {
-		return nil, err
+// the call takes a slot of ChanAsynRet unless there is no capacity
+// (ErrTooManyCalls or ErrFull), then its result goes through ChanAsynRet
+func (c *Client) trySend(ac *asynCallInfo, wait <-chan time.Time) error {
+	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		return ErrTooManyCalls
 	}
 
-	ri := <-c.chanSyncRet
-	return assert(ri.ret), ri.err
-}
+	if ac.exec != nil {
+		c.pendingAsynCall++
+		ac.exec(func(ret interface{}, err error) {
+			c.ChanAsynRet <- &RetInfo{ret: ret, err: err, cb: ac.cb, traceID: ac.traceID}
+		})
+		return nil
+	}
 
-func (c *Client) asynCall(id interface{}, args []interface{}, cb interface{}, n int) {
-	f, err := c.f(id, n)
-	if err != nil {
-		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
-		return
+	f, err := getFunc(ac.s, ac.id, ac.n)
+	if err == nil {
+		err = ac.s.send(&CallInfo{
+			id:       ac.id,
+			f:        f,
+			args:     ac.args,
+			chanRet:  c.ChanAsynRet,
+			cb:       ac.cb,
+			time:     time.Now(),
+			priority: ac.s.priorities[ac.id],
+			traceID:  ac.traceID,
+		}, wait)
+		if err == ErrFull {
+			return err
+		}
 	}
 
-	err = c.call(&CallInfo{
-		f:       f,
-		args:    args,
-		chanRet: c.ChanAsynRet,
-		cb:      cb,
-	}, false)
+	c.pendingAsynCall++
 	if err != nil {
-		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
-		return
+		c.ChanAsynRet <- &RetInfo{err: err, cb: ac.cb, traceID: ac.traceID}
 	}
+	return nil
 }
 
 func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
@@ -340,17 +510,30 @@ func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
 		panic("definition of callback function is invalid")
 	}
 
-	// too many calls
-	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
-		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
-		return
+	c.asynCall(&asynCallInfo{s: c.s, id: id, args: args, cb: cb, n: n})
+}
+
+// ExtAsynCall issues an asynchronous call which is not served by a local
+// Server (e.g. a call to a cluster node). exec must call done exactly once,
+// from any goroutine, and the callback is then executed by Cb as usual.
+func (c *Client) ExtAsynCall(exec func(done func(ret interface{}, err error)), cb interface{}) {
+	switch cb.(type) {
+	case func(error):
+	case func(interface{}, error):
+	case func([]interface{}, error):
+	default:
+		panic("definition of callback function is invalid")
 	}
 
-	c.asynCall(id, args, cb, n)
-	c.pendingAsynCall++
+	c.asynCall(&asynCallInfo{cb: cb, exec: exec})
 }
 
 func execCb(ri *RetInfo) {
+	if ri.traceID != "" {
+		prev := log.SetTraceID(ri.traceID)
+		defer log.SetTraceID(prev)
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			if conf.LenStackBuf > 0 {
@@ -380,14 +563,24 @@ func execCb(ri *RetInfo) {
 func (c *Client) Cb(ri *RetInfo) {
 	c.pendingAsynCall--
 	execCb(ri)
+	c.Flush()
 }
 
 func (c *Client) Close() {
+	for e := c.backlog.Front(); e != nil; e = c.backlog.Front() {
+		c.reject(c.backlog.Remove(e).(*asynCallInfo), errors.New("chanrpc client closed"))
+	}
+
 	for c.pendingAsynCall > 0 {
 		c.Cb(<-c.ChanAsynRet)
 	}
 }
 
+// the calls whose callback is not executed, the queued calls excluded
+func (c *Client) Pending() int {
+	return c.pendingAsynCall
+}
+
 func (c *Client) Idle() bool {
-	return c.pendingAsynCall == 0
+	return c.pendingAsynCall == 0 && c.backlog.Len() == 0
 }
@@ -0,0 +1,55 @@
+package chanrpc
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+var (
+	ErrNotRegistered = errors.New("chanrpc function not registered")
+	ErrClosed        = errors.New("chanrpc server closed")
+	ErrFull          = errors.New("chanrpc channel full")
+)
+
+// DeadLetterHandler is called with the Go calls which are dropped, on the
+// goroutine of the caller (or the one closing the server)
+type DeadLetterHandler func(id interface{}, args []interface{}, err error)
+
+type DeadLetterStats struct {
+	NotRegistered uint64
+	Closed        uint64
+	Full          uint64
+}
+
+// you must call the function before calling Open and Go
+func (s *Server) SetDeadLetterHandler(h DeadLetterHandler) {
+	s.deadLetterHandler = h
+}
+
+// goroutine safe
+func (s *Server) DeadLetters() DeadLetterStats {
+	return DeadLetterStats{
+		NotRegistered: atomic.LoadUint64(&s.deadLetters.NotRegistered),
+		Closed:        atomic.LoadUint64(&s.deadLetters.Closed),
+		Full:          atomic.LoadUint64(&s.deadLetters.Full),
+	}
+}
+
+func (s *Server) deadLetter(id interface{}, args []interface{}, err error) {
+	switch err {
+	case ErrNotRegistered:
+		atomic.AddUint64(&s.deadLetters.NotRegistered, 1)
+	case ErrClosed:
+		atomic.AddUint64(&s.deadLetters.Closed, 1)
+	case ErrFull:
+		atomic.AddUint64(&s.deadLetters.Full, 1)
+	}
+
+	if s.deadLetterHandler != nil {
+		s.deadLetterHandler(id, args, err)
+	} else {
+		log.Debug("chanrpc call %v %v dropped: %v", s.Name, id, err)
+	}
+}
@@ -1,10 +1,15 @@
 package chanrpc_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
 )
 
 func Example() {
@@ -36,10 +41,7 @@ func Example() {
 		wg.Done()
 
 		for {
-			err := s.Exec(<-s.ChanCall)
-			if err != nil {
-				fmt.Println(err)
-			}
+			s.Exec(<-s.ChanCall)
 		}
 	}()
 
@@ -129,3 +131,348 @@ func Example() {
 	// 1 2 3
 	// 3
 }
+
+func ExampleClient_Call1Context() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("slow", func(args []interface{}) interface{} {
+		time.Sleep(100 * time.Millisecond)
+		return "slow"
+	})
+
+	s.Register("f1", func(args []interface{}) interface{} {
+		return 1
+	})
+
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+
+	c := s.Open(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.Call1Context(ctx, "slow")
+	fmt.Println(err)
+
+	// the late reply of "slow" is dropped
+	r1, err := c.Call1("f1")
+	fmt.Println(r1, err)
+
+	s.Close()
+
+	// Output:
+	// context deadline exceeded
+	// 1 <nil>
+}
+
+type LoginReq struct {
+	Name string
+}
+
+type LoginResp struct {
+	ID int
+}
+
+func ExampleServer_Register() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("login", func(req *LoginReq) (*LoginResp, error) {
+		if req.Name == "" {
+			return nil, errors.New("empty name")
+		}
+		return &LoginResp{ID: 1}, nil
+	})
+
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+
+	c := s.Open(0)
+
+	ret, err := c.Call1("login", &LoginReq{Name: "leaf"})
+	fmt.Println(ret.(*LoginResp).ID, err)
+
+	_, err = c.Call1("login", &LoginReq{})
+	fmt.Println(err)
+
+	_, err = c.Call1("login", "leaf")
+	fmt.Println(err)
+
+	_, err = c.Call1("login")
+	fmt.Println(err)
+
+	err = c.Call0("login", &LoginReq{Name: "leaf"})
+	fmt.Println(err)
+
+	// Output:
+	// 1 <nil>
+	// empty name
+	// argument 0: string is not *chanrpc_test.LoginReq
+	// 1 arguments expected, got 0
+	// function id login: return type mismatch
+}
+
+func ExampleServer_Stats() {
+	s := chanrpc.NewServer(10)
+	s.Name = "game"
+
+	s.Register("f0", func(args []interface{}) {})
+
+	s.Go("f0")
+	s.Go("f0")
+	fmt.Println(s.Stats().QueueLen)
+
+	s.Exec(<-s.ChanCall)
+	s.Exec(<-s.ChanCall)
+
+	st := s.Stats()
+	fmt.Println(st.Name, st.QueueLen, st.QueueCap)
+	for _, fs := range st.Funcs {
+		fmt.Println(fs.ID, fs.Calls)
+	}
+
+	// listed for the console until closed
+	chanrpc.ListServer(s)
+	fmt.Println(len(chanrpc.Servers()))
+	s.Close()
+	fmt.Println(len(chanrpc.Servers()))
+
+	// Output:
+	// 2
+	// game 0 10
+	// f0 2
+	// 1
+	// 0
+}
+
+func ExampleServer_Use() {
+	s := chanrpc.NewServer(10)
+
+	// audit
+	s.Use(func(id interface{}, args []interface{}, invoke chanrpc.Invoker) (interface{}, error) {
+		ret, err := invoke(id, args)
+		fmt.Println("audit:", id, args, ret, err)
+		return ret, err
+	})
+
+	// auth
+	s.Use(func(id interface{}, args []interface{}, invoke chanrpc.Invoker) (interface{}, error) {
+		if args[0] != "admin" {
+			return nil, errors.New("permission denied")
+		}
+		return invoke(id, args[1:])
+	})
+
+	s.Register("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+
+	c := s.Open(0)
+	c.Call1("add", "admin", 1, 2)
+	c.Call1("add", "guest", 1, 2)
+
+	// Output:
+	// audit: add [admin 1 2] 3 <nil>
+	// audit: add [guest 1 2] <nil> permission denied
+}
+
+func ExampleServer_TryGo() {
+	s := chanrpc.NewServer(1)
+
+	s.SetDeadLetterHandler(func(id interface{}, args []interface{}, err error) {
+		fmt.Println("dropped:", id, args, err)
+	})
+
+	s.Register("f0", func(args []interface{}) {})
+
+	fmt.Println(s.TryGo("f0", 1))
+	fmt.Println(s.TryGo("f0", 2))
+	fmt.Println(s.TryGo("f1", 3))
+
+	s.Close()
+	s.Go("f0", 4)
+
+	fmt.Printf("%+v\n", s.DeadLetters())
+
+	// Output:
+	// <nil>
+	// dropped: f0 [2] chanrpc channel full
+	// chanrpc channel full
+	// dropped: f1 [3] chanrpc function not registered
+	// chanrpc function not registered
+	// dropped: f0 [1] chanrpc server closed
+	// dropped: f0 [4] chanrpc server closed
+	// {NotRegistered:1 Closed:2 Full:1}
+}
+
+func ExampleClient_SetBackpressure() {
+	s := chanrpc.NewServer(10)
+
+	s.Register("f1", func(args []interface{}) interface{} {
+		return args[0]
+	})
+
+	cb := func(ret interface{}, err error) {
+		fmt.Println(ret, err)
+	}
+
+	// fail fast
+	c := s.Open(1)
+	c.AsynCall("f1", 1, cb)
+	c.AsynCall("f1", 2, cb)
+
+	s.Exec(<-s.ChanCall)
+	c.Cb(<-c.ChanAsynRet)
+
+	// queue
+	c = s.Open(1)
+	c.SetBackpressure(chanrpc.Backpressure{Policy: chanrpc.Queue, QueueLen: 1})
+	c.AsynCall("f1", 3, cb)
+	c.AsynCall("f1", 4, cb)
+	c.AsynCall("f1", 5, cb)
+	fmt.Printf("%+v\n", c.Stats())
+
+	s.Exec(<-s.ChanCall)
+	c.Cb(<-c.ChanAsynRet)
+	s.Exec(<-s.ChanCall)
+	c.Cb(<-c.ChanAsynRet)
+
+	// block
+	c = s.Open(1)
+	c.SetBackpressure(chanrpc.Backpressure{Policy: chanrpc.Block, Timeout: time.Second})
+	c.AsynCall("f1", 6, cb)
+	go s.Exec(<-s.ChanCall)
+	c.AsynCall("f1", 7, cb)
+
+	s.Exec(<-s.ChanCall)
+	c.Close()
+
+	// Output:
+	// <nil> too many calls
+	// 1 <nil>
+	// <nil> too many calls
+	// {Calls:3 Rejected:1 Queued:1 QueueLen:1 Blocked:0 BlockTime:0s}
+	// 3 <nil>
+	// 4 <nil>
+	// 6 <nil>
+	// 7 <nil>
+}
+
+func ExampleServer_SetPriority() {
+	s := chanrpc.NewServer(10)
+
+	f := func(args []interface{}) {
+		fmt.Println(args[0])
+	}
+	s.Register("msg", f)
+	s.Register("kick", f)
+	s.SetPriority("kick", chanrpc.PriorityHigh)
+	s.SetLane(chanrpc.PriorityUrgent, 10)
+
+	s.Go("msg", "msg 1")
+	s.Go("msg", "msg 2")
+	s.Go("kick", "kick")
+	s.GoPriority(chanrpc.PriorityUrgent, "msg", "urgent msg")
+	s.GoPriority(chanrpc.PriorityHigh, "msg", "high msg")
+
+	s.Drain()
+	for len(s.ChanCall) > 0 {
+		s.Exec(<-s.ChanCall)
+	}
+
+	// Output:
+	// urgent msg
+	// kick
+	// high msg
+	// msg 1
+	// msg 2
+}
+
+func Example_traceID() {
+	conf.LogTrace = true
+	defer func() { conf.LogTrace = false }()
+
+	s := chanrpc.NewServer(10)
+
+	s.Register("f", func(args []interface{}) interface{} {
+		return log.TraceID()
+	})
+
+	c := s.Open(10)
+	log.SetTraceID("a1b2c3")
+	c.AsynCall("f", func(ret interface{}, err error) {
+		fmt.Println(ret, log.TraceID())
+	})
+	log.SetTraceID("")
+
+	s.Exec(<-s.ChanCall)
+	fmt.Printf("%q\n", log.TraceID())
+	c.Cb(<-c.ChanAsynRet)
+	fmt.Printf("%q\n", log.TraceID())
+
+	// Output:
+	// ""
+	// a1b2c3 a1b2c3
+	// ""
+}
+
+func ExampleClient_AsynGather() {
+	var servers []*chanrpc.Server
+	for zone := 1; zone <= 3; zone++ {
+		zone := zone
+		s := chanrpc.NewServer(10)
+		s.Register("online", func(args []interface{}) interface{} {
+			return zone * 100
+		})
+		servers = append(servers, s)
+	}
+	exec := func(s *chanrpc.Server) {
+		s.Exec(<-s.ChanCall)
+	}
+
+	c := chanrpc.NewClient(10)
+	cb := func(results []chanrpc.GatherResult) {
+		fmt.Println(results)
+	}
+
+	// all
+	c.AsynGather(servers, chanrpc.GatherOptions{}, "online", nil, cb)
+	for _, s := range servers {
+		exec(s)
+		c.Cb(<-c.ChanAsynRet)
+	}
+
+	// first 2
+	c.AsynGather(servers, chanrpc.GatherOptions{N: 2}, "online", nil, cb)
+	exec(servers[2])
+	c.Cb(<-c.ChanAsynRet)
+	exec(servers[0])
+	c.Cb(<-c.ChanAsynRet)
+	exec(servers[1])
+	c.Cb(<-c.ChanAsynRet)
+
+	// timeout
+	c.AsynGather(servers, chanrpc.GatherOptions{Timeout: 10 * time.Millisecond}, "online", nil, cb)
+	exec(servers[1])
+	c.Cb(<-c.ChanAsynRet)
+	c.Cb(<-c.ChanAsynRet)
+	exec(servers[0])
+	exec(servers[2])
+	c.Close()
+
+	// Output:
+	// [{100 <nil>} {200 <nil>} {300 <nil>}]
+	// [{100 <nil>} {<nil> chanrpc no response} {300 <nil>}]
+	// [{<nil> chanrpc no response} {200 <nil>} {<nil> chanrpc no response}]
+}
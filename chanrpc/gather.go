@@ -0,0 +1,128 @@
+package chanrpc
+
+import (
+	"errors"
+	"time"
+)
+
+type GatherOptions struct {
+	// the callback is executed once N calls succeed, 0 means all the calls
+	N int
+	// the callback is executed when the timeout expires, 0 means no timeout
+	Timeout time.Duration
+}
+
+// the result of a call, the results are in the order of the calls
+type GatherResult struct {
+	Ret interface{}
+	Err error
+}
+
+// the error of the calls without a response when the callback is executed
+var ErrNoResponse = errors.New("chanrpc no response")
+
+type gather struct {
+	c         *Client
+	results   []GatherResult
+	responded []bool
+	nResp     int
+	nSucc     int
+	need      int
+	timer     *time.Timer
+	cb        func(results []GatherResult)
+	done      bool
+}
+
+// AsynGather calls the function on every server with the same arguments,
+// the function must return one value (as Call1). The callback is executed
+// once with all the results, on the goroutine of the client.
+func (c *Client) AsynGather(servers []*Server, opts GatherOptions, id interface{}, args []interface{}, cb func(results []GatherResult)) {
+	acs := make([]*asynCallInfo, len(servers))
+	for i, s := range servers {
+		acs[i] = &asynCallInfo{s: s, id: id, args: args, n: 1}
+	}
+	c.gather(acs, opts, cb)
+}
+
+// ExtAsynGather is AsynGather with calls which are not served by a local
+// Server, each exec is called as in ExtAsynCall
+func (c *Client) ExtAsynGather(execs []func(done func(ret interface{}, err error)), opts GatherOptions, cb func(results []GatherResult)) {
+	acs := make([]*asynCallInfo, len(execs))
+	for i, exec := range execs {
+		acs[i] = &asynCallInfo{exec: exec}
+	}
+	c.gather(acs, opts, cb)
+}
+
+func (c *Client) gather(acs []*asynCallInfo, opts GatherOptions, cb func(results []GatherResult)) {
+	if cb == nil {
+		panic("callback function not found")
+	}
+
+	g := &gather{
+		c:         c,
+		results:   make([]GatherResult, len(acs)),
+		responded: make([]bool, len(acs)),
+		need:      opts.N,
+		cb:        cb,
+	}
+	if g.need <= 0 || g.need > len(acs) {
+		g.need = len(acs)
+	}
+	for i := range g.results {
+		g.results[i].Err = ErrNoResponse
+	}
+
+	if len(acs) == 0 {
+		execCb(&RetInfo{cb: func(error) { g.finish() }})
+		return
+	}
+
+	// the timeout takes a pending call, it is given back by finish
+	if opts.Timeout > 0 {
+		c.pendingAsynCall++
+		ri := &RetInfo{cb: func(error) { g.finish() }}
+		g.timer = time.AfterFunc(opts.Timeout, func() {
+			c.ChanAsynRet <- ri
+		})
+	}
+
+	for i, ac := range acs {
+		i := i
+		ac.cb = func(ret interface{}, err error) {
+			g.result(i, ret, err)
+		}
+		c.asynCall(ac)
+	}
+}
+
+func (g *gather) result(i int, ret interface{}, err error) {
+	if g.done || g.responded[i] {
+		return
+	}
+
+	g.responded[i] = true
+	g.results[i] = GatherResult{Ret: ret, Err: err}
+	g.nResp++
+	if err == nil {
+		g.nSucc++
+	}
+
+	if g.nSucc >= g.need || g.nResp == len(g.results) {
+		g.finish()
+	}
+}
+
+func (g *gather) finish() {
+	if g.done {
+		return
+	}
+	g.done = true
+
+	// the timeout is not sent
+	if g.timer != nil && g.timer.Stop() {
+		g.c.pendingAsynCall--
+	}
+
+	g.cb(g.results)
+}
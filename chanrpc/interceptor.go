@@ -0,0 +1,31 @@
+package chanrpc
+
+// Invoker executes the function, or the next interceptor
+type Invoker func(id interface{}, args []interface{}) (interface{}, error)
+
+// Interceptor wraps every function executed by a server, it may inspect or
+// change the arguments, the return value and the error, or not call invoke
+// at all. The return value must match the type expected by the caller.
+type Interceptor func(id interface{}, args []interface{}, invoke Invoker) (interface{}, error)
+
+// Use appends the interceptor, the first one is the outermost
+// you must call the function before calling Open and Go
+func (s *Server) Use(i Interceptor) {
+	s.interceptors = append(s.interceptors, i)
+}
+
+func (s *Server) invoke(ci *CallInfo) (interface{}, error) {
+	f := ci.f
+	invoke := func(id interface{}, args []interface{}) (interface{}, error) {
+		return call(f, args)
+	}
+
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := s.interceptors[i], invoke
+		invoke = func(id interface{}, args []interface{}) (interface{}, error) {
+			return interceptor(id, args, next)
+		}
+	}
+
+	return invoke(ci.id, ci.args)
+}
@@ -0,0 +1,130 @@
+package chanrpc
+
+import (
+	"fmt"
+)
+
+// the calls of a server are queued in lanes by priority, ChanCall is the
+// lane of PriorityNormal and the other lanes exist once they are used
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityUrgent
+	numPriorities
+)
+
+// the calls executed by Drain at most, so that the lower lanes still make
+// progress when the higher ones are flooded
+const maxDrain = 16
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityUrgent:
+		return "urgent"
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// SetLane creates the lane of the priority with the buffer length l
+// you must call the function before calling Open and Go
+func (s *Server) SetLane(p Priority, l int) {
+	if p <= PriorityNormal || p >= numPriorities {
+		panic(fmt.Sprintf("invalid lane %v", p))
+	}
+	s.lanes[p] = make(chan *CallInfo, l)
+}
+
+// SetPriority queues the calls of the function in the lane of the
+// priority, the lane is created with the length of ChanCall if needed
+// you must call the function before calling Open and Go
+func (s *Server) SetPriority(id interface{}, p Priority) {
+	if _, ok := s.functions[id]; !ok {
+		panic(fmt.Sprintf("function id %v: function not registered", id))
+	}
+	if p > PriorityNormal && p < numPriorities && s.lanes[p] == nil {
+		s.SetLane(p, cap(s.ChanCall))
+	}
+	s.priorities[id] = p
+}
+
+// Lane returns the channel of the priority, nil if the lane does not exist
+func (s *Server) Lane(p Priority) chan *CallInfo {
+	if p == PriorityNormal {
+		return s.ChanCall
+	}
+	if p < PriorityNormal || p >= numPriorities {
+		return nil
+	}
+	return s.lanes[p]
+}
+
+// the lanes of the functions are created by SetPriority, so the calls only
+// go to ChanCall with PriorityNormal
+func (s *Server) lane(p Priority) chan *CallInfo {
+	if ch := s.Lane(p); ch != nil {
+		return ch
+	}
+	return s.ChanCall
+}
+
+// GoPriority is Go in the lane of the priority instead of the one of the
+// function, the lane must exist (see SetLane)
+// goroutine safe
+func (s *Server) GoPriority(p Priority, id interface{}, args ...interface{}) {
+	if s.Lane(p) == nil {
+		panic(fmt.Sprintf("lane %v not created", p))
+	}
+	s.goCall(id, args, p, true)
+}
+
+// Drain executes the calls waiting in the lanes above PriorityNormal, the
+// highest first, it should be called by the goroutine of the server before
+// it waits for ChanCall and the other lanes
+func (s *Server) Drain() {
+	for i := 0; i < maxDrain; i++ {
+		ci := s.next()
+		if ci == nil {
+			return
+		}
+		s.Exec(ci)
+	}
+}
+
+func (s *Server) next() *CallInfo {
+	for p := numPriorities - 1; p > PriorityNormal; p-- {
+		if s.lanes[p] == nil {
+			continue
+		}
+		select {
+		case ci, ok := <-s.lanes[p]:
+			if ok {
+				return ci
+			}
+		default:
+		}
+	}
+	return nil
+}
+
+// QueueLen returns the calls waiting in all the lanes
+// goroutine safe
+func (s *Server) QueueLen() int {
+	n, _ := s.queueLen()
+	return n
+}
+
+func (s *Server) queueLen() (n int, c int) {
+	for p := PriorityNormal; p < numPriorities; p++ {
+		if ch := s.Lane(p); ch != nil {
+			n += len(ch)
+			c += cap(ch)
+		}
+	}
+	return
+}
@@ -0,0 +1,126 @@
+package chanrpc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+type FuncStats struct {
+	ID          interface{}
+	Calls       uint64
+	QueueTime   time.Duration // total
+	ExecTime    time.Duration // total
+	MaxExecTime time.Duration
+}
+
+type Stats struct {
+	Name        string
+	QueueLen    int // all lanes
+	QueueCap    int
+	DeadLetters DeadLetterStats
+	Funcs       []FuncStats // sorted by ExecTime
+}
+
+var (
+	mutexServers sync.Mutex
+	servers      []*Server
+)
+
+func (s *Server) record(ci *CallInfo, start time.Time) {
+	execTime := time.Since(start)
+	var queueTime time.Duration
+	if !ci.time.IsZero() {
+		queueTime = start.Sub(ci.time)
+	}
+
+	s.mutexStats.Lock()
+	fs := s.stats[ci.id]
+	if fs == nil {
+		fs = &FuncStats{ID: ci.id}
+		s.stats[ci.id] = fs
+	}
+	fs.Calls++
+	fs.QueueTime += queueTime
+	fs.ExecTime += execTime
+	if execTime > fs.MaxExecTime {
+		fs.MaxExecTime = execTime
+	}
+	s.mutexStats.Unlock()
+
+	if conf.SlowCallThreshold > 0 && execTime >= conf.SlowCallThreshold {
+		log.Release("slow chanrpc call %v %v: queue %v, exec %v", s.Name, ci.id, queueTime, execTime)
+	}
+}
+
+// goroutine safe
+func (s *Server) Stats() Stats {
+	st := Stats{
+		Name:        s.Name,
+		DeadLetters: s.DeadLetters(),
+	}
+	st.QueueLen, st.QueueCap = s.queueLen()
+
+	s.mutexStats.Lock()
+	for _, fs := range s.stats {
+		st.Funcs = append(st.Funcs, *fs)
+	}
+	s.mutexStats.Unlock()
+
+	sort.Slice(st.Funcs, func(i, j int) bool {
+		return st.Funcs[i].ExecTime > st.Funcs[j].ExecTime
+	})
+	return st
+}
+
+// ListServer lists the server with a name in Servers until it is closed
+// goroutine safe
+func ListServer(s *Server) {
+	if s.Name == "" {
+		panic("server without a name")
+	}
+
+	mutexServers.Lock()
+	defer mutexServers.Unlock()
+	for _, _s := range servers {
+		if _s == s {
+			return
+		}
+	}
+	servers = append(servers, s)
+}
+
+func unlistServer(s *Server) {
+	mutexServers.Lock()
+	defer mutexServers.Unlock()
+	for i, _s := range servers {
+		if _s == s {
+			servers = append(servers[:i], servers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Servers returns the servers listed by ListServer
+// goroutine safe
+func Servers() []*Server {
+	mutexServers.Lock()
+	defer mutexServers.Unlock()
+	return append([]*Server(nil), servers...)
+}
+
+func (st Stats) String() string {
+	output := fmt.Sprintf("%v: queue %v/%v, dropped %v not registered, %v closed, %v full",
+		st.Name, st.QueueLen, st.QueueCap,
+		st.DeadLetters.NotRegistered, st.DeadLetters.Closed, st.DeadLetters.Full)
+	for _, fs := range st.Funcs {
+		n := time.Duration(fs.Calls)
+		output += fmt.Sprintf("\r\n  %v - calls %v, avg queue %v, avg exec %v, max exec %v",
+			fs.ID, fs.Calls, fs.QueueTime/n, fs.ExecTime/n, fs.MaxExecTime)
+	}
+	return output
+}
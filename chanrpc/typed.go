@@ -0,0 +1,104 @@
+package chanrpc
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// a function with a concrete signature, such as
+// func(*LoginReq, gate.Agent) (*LoginResp, error)
+//
+// the trailing error result is optional, the other results decide how it
+// is called:
+// no result      - Call0
+// one result     - Call1
+// more results   - CallN
+type typedFunc struct {
+	f      reflect.Value
+	in     []reflect.Type
+	n      int
+	hasErr bool
+}
+
+func newTypedFunc(f interface{}) (*typedFunc, error) {
+	v := reflect.ValueOf(f)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%v is not a function", t)
+	}
+	if t.IsVariadic() {
+		return nil, fmt.Errorf("variadic function %v not supported", t)
+	}
+
+	tf := new(typedFunc)
+	tf.f = v
+	for i := 0; i < t.NumIn(); i++ {
+		tf.in = append(tf.in, t.In(i))
+	}
+
+	numOut := t.NumOut()
+	if numOut > 0 && t.Out(numOut-1) == typeOfError {
+		tf.hasErr = true
+		numOut--
+	}
+	switch numOut {
+	case 0:
+		tf.n = 0
+	case 1:
+		tf.n = 1
+	default:
+		tf.n = 2
+	}
+
+	return tf, nil
+}
+
+func (tf *typedFunc) values(args []interface{}) ([]reflect.Value, error) {
+	if len(args) != len(tf.in) {
+		return nil, fmt.Errorf("%v arguments expected, got %v", len(tf.in), len(args))
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		t := tf.in[i]
+		if arg == nil {
+			switch t.Kind() {
+			case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+				in[i] = reflect.Zero(t)
+				continue
+			}
+			return nil, fmt.Errorf("argument %v: nil is not %v", i, t)
+		}
+
+		v := reflect.ValueOf(arg)
+		if !v.Type().AssignableTo(t) {
+			return nil, fmt.Errorf("argument %v: %v is not %v", i, v.Type(), t)
+		}
+		in[i] = v
+	}
+	return in, nil
+}
+
+func (tf *typedFunc) call(in []reflect.Value) (ret interface{}, err error) {
+	out := tf.f.Call(in)
+	if tf.hasErr {
+		if e := out[len(out)-1].Interface(); e != nil {
+			err = e.(error)
+		}
+		out = out[:len(out)-1]
+	}
+
+	switch tf.n {
+	case 1:
+		ret = out[0].Interface()
+	case 2:
+		rets := make([]interface{}, len(out))
+		for i, o := range out {
+			rets[i] = o.Interface()
+		}
+		ret = rets
+	}
+	return
+}
@@ -2,18 +2,41 @@ package cluster
 
 import (
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/rufeng18/tinyleaf/chanrpc"
 	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
 	"github.com/rufeng18/tinyleaf/network"
 )
 
 var (
-	server  *network.TCPServer
-	clients []*network.TCPClient
+	server *network.TCPServer
+
+	// addr -> client
+	mutexClients sync.Mutex
+	clients      = make(map[string]*network.TCPClient)
+
+	// name -> local chanrpc server exposed to the other nodes
+	servers = make(map[string]*chanrpc.Server)
 )
 
+// you must call the function before calling cluster.Init
+// goroutine not safe
+func Register(name string, s *chanrpc.Server) {
+	if _, ok := servers[name]; ok {
+		log.Fatal("chanrpc server %v is already registered", name)
+	}
+
+	servers[name] = s
+}
+
 func Init() {
+	// the local node owns keys too
+	joinRing(nodeName(), conf.NodeRole)
+
 	if conf.ListenAddr != "" {
 		server = new(network.TCPServer)
 		server.Addr = conf.ListenAddr
@@ -21,46 +44,201 @@ func Init() {
 		server.PendingWriteNum = conf.PendingWriteNum
 		server.LenMsgLen = 4
 		server.MaxMsgLen = math.MaxUint32
+		// the default of TCPClient, which the other nodes dial with
+		server.LenExtHeadLen = 2
 		server.NewAgent = newAgent
 
 		server.Start()
 	}
 
+	mutexClients.Lock()
 	for _, addr := range conf.ConnAddrs {
-		client := new(network.TCPClient)
-		client.Addr = addr
-		client.ConnNum = 1
-		client.ConnectInterval = 3 * time.Second
-		client.PendingWriteNum = conf.PendingWriteNum
-		client.LenMsgLen = 4
-		client.MaxMsgLen = math.MaxUint32
-		client.NewAgent = newAgent
-
-		client.Start()
-		clients = append(clients, client)
+		dial(addr)
+	}
+	mutexClients.Unlock()
+
+	if discovery != nil {
+		discovery.Start(updatePeers)
 	}
 }
 
 func Destroy() {
+	if discovery != nil {
+		discovery.Stop()
+	}
+
 	if server != nil {
 		server.Close()
 	}
 
-	for _, client := range clients {
+	mutexClients.Lock()
+	for addr, client := range clients {
 		client.Close()
+		delete(clients, addr)
+	}
+	mutexClients.Unlock()
+
+	leaveRing(nodeName(), conf.NodeRole)
+}
+
+// call it with mutexClients locked
+func dial(addr string) {
+	if _, ok := clients[addr]; ok {
+		return
 	}
+
+	client := new(network.TCPClient)
+	client.Addr = addr
+	client.ConnNum = 1
+	client.ConnectInterval = 3 * time.Second
+	client.PendingWriteNum = conf.PendingWriteNum
+	client.AutoReconnect = true
+	client.LenMsgLen = 4
+	client.MaxMsgLen = math.MaxUint32
+	client.NewAgent = newAgent
+
+	client.Start()
+	clients[addr] = client
 }
 
 type Agent struct {
-	conn *network.TCPConn
+	conn     *network.TCPConn
+	node     NodeInfo
+	joined   bool
+	lastRecv int64
+	closeSig chan bool
+	calls    chan struct{} // the calls being served, see conf.MaxNodeCalls
+	enc      encoder
+	dec      decoder
+
+	mutexPending sync.Mutex
+	seq          uint32
+	pending      map[uint32]*pendingCall
+	closeFlag    bool
+}
+
+type pendingCall struct {
+	done  func(interface{}, error)
+	timer *time.Timer // expires the call at its deadline
 }
 
 func newAgent(conn *network.TCPConn) network.Agent {
 	a := new(Agent)
 	a.conn = conn
+	a.closeSig = make(chan bool)
+	a.calls = make(chan struct{}, conf.MaxNodeCalls)
+	a.pending = make(map[uint32]*pendingCall)
+
+	// cluster links are trusted
+	conn.Verify()
 	return a
 }
 
-func (a *Agent) Run() {}
+func (a *Agent) Run() {
+	err := a.writeMsg(&handshakeMsg{Name: nodeName(), Role: conf.NodeRole})
+	if err != nil {
+		log.Error("handshake error: %v", err)
+		return
+	}
+
+	// the heartbeat starts with the handshake, which sets a.node
+	handshakeTimer := time.AfterFunc(conf.HeartbeatTimeout, func() {
+		log.Release("cluster handshake timeout from %v", a.conn.RemoteAddr())
+		a.conn.Close()
+	})
+	defer handshakeTimer.Stop()
+	defer close(a.closeSig)
+
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			log.Debug("read message: %v", err)
+			break
+		}
+		atomic.StoreInt64(&a.lastRecv, time.Now().UnixNano())
+
+		msg, err := a.dec.decode(data)
+		if err != nil {
+			log.Error("decode cluster message error: %v", err)
+			break
+		}
+
+		if !a.joined {
+			hs, ok := msg.(*handshakeMsg)
+			if !ok {
+				log.Error("handshake expected from %v, got %T", a.conn.RemoteAddr(), msg)
+				break
+			}
+			if !handshakeTimer.Stop() {
+				break
+			}
+			a.node = NodeInfo{Name: hs.Name, Role: hs.Role}
+			a.joined = true
+			addAgent(a)
+			go a.heartbeat()
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *heartbeatMsg:
+		case *requestMsg:
+			a.handleRequest(msg)
+		case *responseMsg:
+			a.handleResponse(msg)
+		case *forwardMsg:
+			a.handleForward(msg)
+		case *relayMsg:
+			a.handleRelay(msg)
+		case *publishMsg:
+			a.handlePublish(msg)
+		default:
+			log.Error("invalid cluster message %T", msg)
+		}
+	}
+}
+
+func (a *Agent) heartbeat() {
+	ticker := time.NewTicker(conf.HeartbeatInterval)
+	defer ticker.Stop()
 
-func (a *Agent) OnClose() {}
+	for {
+		select {
+		case <-a.closeSig:
+			return
+		case <-ticker.C:
+			lastRecv := time.Unix(0, atomic.LoadInt64(&a.lastRecv))
+			if time.Since(lastRecv) > conf.HeartbeatTimeout {
+				log.Release("cluster node %v heartbeat timeout", a.node.Name)
+				a.conn.Close()
+				return
+			}
+			a.writeMsg(&heartbeatMsg{Time: time.Now().UnixNano()})
+		}
+	}
+}
+
+func (a *Agent) OnClose() {
+	if a.joined {
+		removeAgent(a)
+	}
+
+	a.mutexPending.Lock()
+	a.closeFlag = true
+	pending := a.pending
+	a.pending = nil
+	a.mutexPending.Unlock()
+
+	for _, pc := range pending {
+		if pc.timer != nil {
+			pc.timer.Stop()
+		}
+		pc.done(nil, errNodeClosed)
+	}
+}
+
+// goroutine safe
+func (a *Agent) writeMsg(msg interface{}) error {
+	return a.enc.write(msg, func(data []byte) error {
+		return a.conn.WriteMsg(data)
+	})
+}
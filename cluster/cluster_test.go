@@ -0,0 +1,446 @@
+package cluster_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/cluster"
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+const (
+	addr = "127.0.0.1:33366"
+	node = "game1"
+)
+
+var (
+	joined    = make(chan string, 1)
+	left      = make(chan string, 1)
+	published = make(chan string, 10)
+	release   = make(chan bool)
+	wedged    = make(chan bool, 1)
+	discovery = new(fakeDiscovery)
+)
+
+type fakeDiscovery struct {
+	update func([]cluster.Peer)
+}
+
+func (d *fakeDiscovery) Start(update func([]cluster.Peer)) {
+	d.update = update
+	update([]cluster.Peer{{Addr: addr}})
+}
+
+func (d *fakeDiscovery) Stop() {}
+
+// the node connects to itself
+func TestMain(m *testing.M) {
+	s := chanrpc.NewServer(10)
+	s.Register("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+	s.Register("fn", func(args []interface{}) []interface{} {
+		return []interface{}{1, "2", 3.0}
+	})
+	s.Register("NodeJoin", func(args []interface{}) {
+		joined <- args[0].(string) + " " + args[1].(string)
+	})
+	s.Register("NodeLeave", func(args []interface{}) {
+		left <- args[0].(string)
+	})
+	s.Register("trace", func(args []interface{}) interface{} {
+		return log.TraceID()
+	})
+	s.Register("wedged", func(args []interface{}) {
+		select {
+		case wedged <- true:
+		default:
+		}
+		<-release
+	})
+	s.Register("OnAnnounce", func(args []interface{}) {
+		published <- args[0].(string)
+	})
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+
+	conf.ListenAddr = addr
+	conf.PendingWriteNum = 100
+	conf.NodeName = node
+	conf.NodeRole = "game"
+	conf.LogTrace = true
+	conf.MaxNodeCalls = 1
+	cluster.Register("game", s)
+	cluster.Subscribe("announce", s, "OnAnnounce")
+	// a watcher never served must not block the others
+	wedgedWatcher := chanrpc.NewServer(0)
+	wedgedWatcher.Register("NodeJoin", func([]interface{}) {})
+	wedgedWatcher.Register("NodeLeave", func([]interface{}) {})
+	cluster.Watch(wedgedWatcher)
+	cluster.Watch(s)
+	cluster.SetSessionHandler(new(sessionHandler))
+	cluster.SetDiscovery(discovery)
+	cluster.Init()
+
+	code := 1
+	select {
+	case info := <-joined:
+		if info == "game1 game" {
+			code = m.Run()
+		}
+	case <-time.After(5 * time.Second):
+	}
+
+	cluster.Destroy()
+	os.Exit(code)
+}
+
+func TestCall(t *testing.T) {
+	if nodes := cluster.Nodes(); len(nodes) != 1 || nodes[0].Name != node {
+		t.Fatalf("Nodes: %v", nodes)
+	}
+
+	r1, err := cluster.Call1(node, "game", "add", 1, 2)
+	if err != nil || r1 != 3 {
+		t.Fatalf("Call1: %v, %v", r1, err)
+	}
+
+	err = cluster.Call0(node, "game", "add", 1, 2)
+	if err == nil || err.Error() != "function id add: return type mismatch" {
+		t.Fatalf("Call0: unexpected error %v", err)
+	}
+
+	rn, err := cluster.CallN(node, "game", "fn")
+	if err != nil || len(rn) != 3 || rn[0] != 1 || rn[1] != "2" || rn[2] != 3.0 {
+		t.Fatalf("CallN: %v, %v", rn, err)
+	}
+
+	_, err = cluster.Call1(node, "login", "add", 1, 2)
+	if err == nil {
+		t.Fatal("Call1: server not registered expected")
+	}
+
+	_, err = cluster.Call1("game2", "game", "add", 1, 2)
+	if err == nil {
+		t.Fatal("Call1: node not connected expected")
+	}
+
+	// asyn
+	c := chanrpc.NewClient(10)
+	var ret interface{}
+	cluster.AsynCall(c, node, "game", "add", 3, 4, func(r interface{}, err error) {
+		ret = r
+	})
+	c.Cb(<-c.ChanAsynRet)
+	if ret != 7 {
+		t.Fatalf("AsynCall: %v", ret)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	defer func() { release <- true }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := cluster.Call0Context(ctx, node, "game", "wedged")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Call0Context: %v", err)
+	}
+}
+
+func TestMaxNodeCalls(t *testing.T) {
+	select {
+	case <-wedged:
+	default:
+	}
+	exit := make(chan error)
+	go func() {
+		exit <- cluster.Call0(node, "game", "wedged")
+	}()
+
+	// the wedged call takes the only slot of the link
+	<-wedged
+	_, err := cluster.Call1(node, "game", "add", 1, 2)
+	if err == nil || err.Error() != "too many calls from node "+node {
+		t.Fatalf("Call1: %v", err)
+	}
+
+	release <- true
+	if err := <-exit; err != nil {
+		t.Fatal(err)
+	}
+	r, err := cluster.Call1(node, "game", "add", 1, 2)
+	if err != nil || r != 3 {
+		t.Fatalf("Call1: %v, %v", r, err)
+	}
+}
+
+func TestAsynCallTimeout(t *testing.T) {
+	defer func() { release <- true }()
+
+	timeout := conf.CallTimeout
+	conf.CallTimeout = 50 * time.Millisecond
+	defer func() { conf.CallTimeout = timeout }()
+
+	c := chanrpc.NewClient(10)
+	var err error
+	cluster.AsynCall(c, node, "game", "wedged", func(e error) {
+		err = e
+	})
+	select {
+	case ri := <-c.ChanAsynRet:
+		c.Cb(ri)
+	case <-time.After(time.Second):
+		t.Fatal("AsynCall not expired")
+	}
+	if err != context.DeadlineExceeded || c.Pending() != 0 {
+		t.Fatalf("AsynCall: %v, %v pending", err, c.Pending())
+	}
+}
+
+func TestAsynGather(t *testing.T) {
+	c := chanrpc.NewClient(10)
+	var results []chanrpc.GatherResult
+	cluster.AsynGather(c, []string{node, "game2"}, chanrpc.GatherOptions{}, "game", "add", []interface{}{1, 2}, func(r []chanrpc.GatherResult) {
+		results = r
+	})
+	for results == nil {
+		c.Cb(<-c.ChanAsynRet)
+	}
+	if results[0].Ret != 3 || results[0].Err != nil || results[1].Err == nil {
+		t.Fatalf("AsynGather: %v", results)
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	log.SetTraceID("a1b2c3")
+	defer log.SetTraceID("")
+
+	r, err := cluster.Call1(node, "game", "trace")
+	if err != nil || r != "a1b2c3" {
+		t.Fatalf("Call1: %v, %v", r, err)
+	}
+}
+
+// echo backend
+type sessionHandler struct{}
+
+func (h *sessionHandler) OnSessionOpen(s *cluster.Session) {
+	s.WriteMsg([]byte("hello " + s.Addr))
+}
+
+func (h *sessionHandler) OnSessionMsg(s *cluster.Session, data []byte) {
+	if string(data) == "bye" {
+		s.Close()
+		return
+	}
+	s.WriteMsg(data)
+}
+
+func (h *sessionHandler) OnSessionClose(s *cluster.Session) {}
+
+// client connection of the gate
+type sessionConn struct {
+	msgs   chan string
+	closed chan bool
+}
+
+func (c *sessionConn) WriteMsg(args ...[]byte) error {
+	var msg string
+	for _, arg := range args {
+		msg += string(arg)
+	}
+	c.msgs <- msg
+	return nil
+}
+
+func (c *sessionConn) Close() {
+	c.closed <- true
+}
+
+func (c *sessionConn) Verify() {}
+
+func TestSession(t *testing.T) {
+	conn := &sessionConn{msgs: make(chan string, 10), closed: make(chan bool, 1)}
+	id, err := cluster.OpenSession(node, "1.2.3.4:5", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(msg string) {
+		select {
+		case m := <-conn.msgs:
+			if m != msg {
+				t.Fatalf("got %q, want %q", m, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q timeout", msg)
+		}
+	}
+	expect("hello 1.2.3.4:5")
+
+	cluster.ForwardMsg(id, []byte("ping"))
+	expect("ping")
+
+	cluster.ForwardMsg(id, []byte("bye"))
+	select {
+	case <-conn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close timeout")
+	}
+	cluster.CloseSession(id)
+
+	if err := cluster.ForwardMsg(id, []byte("ping")); err == nil {
+		t.Fatal("ForwardMsg: session not found expected")
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := cluster.NewRing(160)
+	if r.Get("1001") != "" {
+		t.Fatal("empty ring")
+	}
+
+	r.Add("game1")
+	r.Add("game2")
+	r.Add("game3")
+
+	owners := make(map[string]string)
+	count := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i)
+		owners[key] = r.Get(key)
+		count[owners[key]]++
+	}
+	for _, node := range []string{"game1", "game2", "game3"} {
+		if count[node] < 500 {
+			t.Fatalf("unbalanced ring: %v", count)
+		}
+	}
+
+	// only the keys of the removed node move
+	r.Remove("game2")
+	for key, owner := range owners {
+		if owner != "game2" && r.Get(key) != owner {
+			t.Fatalf("key %v moved from %v to %v", key, owner, r.Get(key))
+		}
+	}
+
+	// and come back
+	r.Add("game2")
+	for key, owner := range owners {
+		if r.Get(key) != owner {
+			t.Fatalf("key %v moved from %v to %v", key, owner, r.Get(key))
+		}
+	}
+}
+
+func TestOwner(t *testing.T) {
+	owner, err := cluster.Owner("game", 1001)
+	if err != nil || owner != node {
+		t.Fatalf("Owner: %v, %v", owner, err)
+	}
+
+	if _, err := cluster.Owner("login", 1001); err == nil {
+		t.Fatal("Owner: no node expected")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	cluster.Publish("announce", "hello")
+	cluster.Publish("guild", "ignored")
+	select {
+	case msg := <-published:
+		if msg != "hello" {
+			t.Fatalf("got %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// published once even if the node links to itself
+	time.Sleep(100 * time.Millisecond)
+	if len(published) != 0 {
+		t.Fatal("published more than once")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	wait := func(c chan string) {
+		select {
+		case name := <-c:
+			if name != node && name != "game1 game" {
+				t.Fatalf("got %v", name)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	discovery.update(nil)
+	wait(left)
+	if nodes := cluster.Nodes(); len(nodes) != 0 {
+		t.Fatalf("Nodes: %v", nodes)
+	}
+	// without the link the local node is called directly
+	if r, err := cluster.Call1(node, "game", "add", 1, 2); err != nil || r != 3 {
+		t.Fatalf("Call1: %v, %v", r, err)
+	}
+	if owner, err := cluster.Owner("game", 1001); err != nil || owner != node {
+		t.Fatalf("Owner: %v, %v", owner, err)
+	}
+
+	discovery.update([]cluster.Peer{{Addr: addr}})
+	wait(joined)
+	if _, err := cluster.Call1(node, "game", "add", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nodes.json")
+	err = ioutil.WriteFile(path, []byte(`[{"Name": "game1", "Addr": "127.0.0.1:3564"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates := make(chan []cluster.Peer, 10)
+	d := &cluster.FileDiscovery{Path: path, Interval: 10 * time.Millisecond}
+	d.Start(func(peers []cluster.Peer) {
+		updates <- peers
+	})
+	defer d.Stop()
+
+	if peers := <-updates; len(peers) != 1 || peers[0].Name != "game1" || peers[0].Addr != "127.0.0.1:3564" {
+		t.Fatalf("got %v", peers)
+	}
+
+	err = ioutil.WriteFile(path, []byte(`[{"Name": "game1", "Addr": "127.0.0.1:3564"}, {"Name": "game2", "Addr": "127.0.0.1:3565"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case peers := <-updates:
+		if len(peers) != 2 || peers[1].Name != "game2" {
+			t.Fatalf("got %v", peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
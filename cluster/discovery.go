@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+type Peer struct {
+	Name string
+	Role string
+	Addr string
+}
+
+type Discovery interface {
+	// Start reports the whole peer list through update, first before it
+	// returns and then each time the list changes
+	Start(update func(peers []Peer))
+	Stop()
+}
+
+var (
+	discovery Discovery
+
+	// the addrs reported by the discovery, guarded by mutexClients
+	discovered = make(map[string]bool)
+)
+
+// you must call the function before calling cluster.Init
+// goroutine not safe
+func SetDiscovery(d Discovery) {
+	discovery = d
+}
+
+func isStatic(addr string) bool {
+	for _, a := range conf.ConnAddrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// dial the new peers and drop the removed ones, conf.ConnAddrs are kept
+func updatePeers(peers []Peer) {
+	self := nodeName()
+	addrs := make(map[string]bool)
+	for _, p := range peers {
+		if p.Addr == "" || p.Name != "" && p.Name == self {
+			continue
+		}
+		addrs[p.Addr] = true
+	}
+
+	mutexClients.Lock()
+	defer mutexClients.Unlock()
+
+	for addr := range addrs {
+		if !discovered[addr] {
+			log.Release("cluster peer %v discovered", addr)
+			dial(addr)
+		}
+	}
+	for addr := range discovered {
+		if addrs[addr] || isStatic(addr) {
+			continue
+		}
+		log.Release("cluster peer %v removed", addr)
+		if client := clients[addr]; client != nil {
+			delete(clients, addr)
+			// it waits for the reconnecting goroutine
+			go client.Close()
+		}
+	}
+	discovered = addrs
+}
+
+// FileDiscovery reads the peers from a JSON file such as
+// [{"Name": "game1", "Role": "game", "Addr": "127.0.0.1:3564"}]
+// and reloads it when the file is modified.
+type FileDiscovery struct {
+	Path     string
+	Interval time.Duration
+	closeSig chan bool
+	wg       sync.WaitGroup
+	modTime  time.Time
+	size     int64
+}
+
+func (d *FileDiscovery) Start(update func(peers []Peer)) {
+	if d.Interval <= 0 {
+		d.Interval = 3 * time.Second
+		log.Release("invalid Interval, reset to %v", d.Interval)
+	}
+	d.closeSig = make(chan bool)
+
+	d.check(update)
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.closeSig:
+				return
+			case <-ticker.C:
+				d.check(update)
+			}
+		}
+	}()
+}
+
+func (d *FileDiscovery) Stop() {
+	close(d.closeSig)
+	d.wg.Wait()
+}
+
+func (d *FileDiscovery) check(update func(peers []Peer)) {
+	fi, err := os.Stat(d.Path)
+	if err != nil {
+		log.Error("%v", err)
+		return
+	}
+	if fi.ModTime().Equal(d.modTime) && fi.Size() == d.size {
+		return
+	}
+
+	data, err := ioutil.ReadFile(d.Path)
+	if err != nil {
+		log.Error("%v", err)
+		return
+	}
+	var peers []Peer
+	err = json.Unmarshal(data, &peers)
+	if err != nil {
+		log.Error("invalid peer file %v: %v", d.Path, err)
+		return
+	}
+
+	d.modTime = fi.ModTime()
+	d.size = fi.Size()
+	update(peers)
+}
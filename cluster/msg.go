@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sync"
+)
+
+// call types
+const (
+	callGo = iota
+	call0
+	call1
+	callN
+)
+
+type handshakeMsg struct {
+	Name string
+	Role string
+}
+
+type heartbeatMsg struct {
+	Time int64
+}
+
+type requestMsg struct {
+	Seq    uint32
+	Type   uint8
+	Server string
+	ID     interface{}
+	Args   []interface{}
+	Trace  string
+	// the time left to the caller in nanoseconds, 0 for no limit, relative
+	// to not depend on the clocks of the nodes
+	Timeout int64
+}
+
+type responseMsg struct {
+	Seq uint32
+	Ret interface{}
+	Err string
+}
+
+func init() {
+	gob.Register(new(handshakeMsg))
+	gob.Register(new(heartbeatMsg))
+	gob.Register(new(requestMsg))
+	gob.Register(new(responseMsg))
+	gob.Register(new(forwardMsg))
+	gob.Register(new(relayMsg))
+	gob.Register(new(publishMsg))
+	gob.Register([]interface{}{})
+}
+
+// RegisterType records the concrete type of value so that it can be used as
+// a function id, an argument or a return value of a cluster call.
+// you must call the function before calling cluster.Init
+func RegisterType(value interface{}) {
+	gob.Register(value)
+}
+
+// each link carries a gob stream, so that a type is described once. A frame
+// starts with streamReset when the stream starts over, since the state of an
+// encoder is lost when a message fails.
+const (
+	streamNext byte = iota
+	streamReset
+)
+
+type encoder struct {
+	sync.Mutex
+	buf bytes.Buffer
+	enc *gob.Encoder
+}
+
+// write encodes msg and passes the frame to w, the frames are written in the
+// order of the stream
+// goroutine safe
+func (e *encoder) write(msg interface{}, w func(data []byte) error) error {
+	e.Lock()
+	defer e.Unlock()
+
+	e.buf.Reset()
+	if e.enc == nil {
+		e.buf.WriteByte(streamReset)
+		e.enc = gob.NewEncoder(&e.buf)
+	} else {
+		e.buf.WriteByte(streamNext)
+	}
+
+	err := e.enc.Encode(&msg)
+	if err == nil {
+		err = w(e.buf.Bytes())
+	}
+	if err != nil {
+		// the types described by the message are lost
+		e.enc = nil
+	}
+	return err
+}
+
+// goroutine not safe
+type decoder struct {
+	buf bytes.Buffer
+	dec *gob.Decoder
+}
+
+func (d *decoder) decode(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty frame")
+	}
+	if data[0] == streamReset {
+		d.buf.Reset()
+		d.dec = gob.NewDecoder(&d.buf)
+	} else if d.dec == nil {
+		return nil, errors.New("stream not started")
+	}
+
+	d.buf.Write(data[1:])
+	var msg interface{}
+	err := d.dec.Decode(&msg)
+	return msg, err
+}
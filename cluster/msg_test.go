@@ -0,0 +1,40 @@
+package cluster
+
+import "testing"
+
+func TestStream(t *testing.T) {
+	var enc encoder
+	var dec decoder
+	var frames [][]byte
+	write := func(data []byte) error {
+		frames = append(frames, append([]byte(nil), data...))
+		return nil
+	}
+
+	type unregistered struct{ A int }
+	msgs := []*requestMsg{
+		{Seq: 1, Args: []interface{}{1}},
+		{Seq: 2, Args: []interface{}{unregistered{}}},
+		{Seq: 3, Args: []interface{}{"a"}},
+		{Seq: 4, Args: []interface{}{"b"}},
+	}
+	for _, msg := range msgs {
+		err := enc.write(msg, write)
+		if (err != nil) != (msg.Seq == 2) {
+			t.Fatalf("write %v: %v", msg.Seq, err)
+		}
+	}
+
+	// the stream starts over after the failed message, the types are
+	// described once per stream
+	if len(frames) != 3 || frames[0][0] != streamReset || frames[1][0] != streamReset ||
+		frames[2][0] != streamNext || len(frames[2]) >= len(frames[1]) {
+		t.Fatalf("frames: %v", frames)
+	}
+	for i, seq := range []uint32{1, 3, 4} {
+		msg, err := dec.decode(frames[i])
+		if err != nil || msg.(*requestMsg).Seq != seq {
+			t.Fatalf("decode %v: %v, %v", seq, msg, err)
+		}
+	}
+}
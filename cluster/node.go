@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+type NodeInfo struct {
+	Name string
+	Role string
+}
+
+type node struct {
+	NodeInfo
+	agents []*Agent
+}
+
+var (
+	// name -> node
+	mutexNodes sync.Mutex
+	nodes      = make(map[string]*node)
+
+	// receive "NodeJoin" and "NodeLeave" with args: name, role, the events
+	// are dropped if the queue is full
+	watchers []*chanrpc.Server
+)
+
+// you must call the function before calling cluster.Init
+// goroutine not safe
+func Watch(s *chanrpc.Server) {
+	watchers = append(watchers, s)
+}
+
+func nodeName() string {
+	if conf.NodeName != "" {
+		return conf.NodeName
+	}
+	return conf.ListenAddr
+}
+
+// goroutine safe
+func Nodes() []NodeInfo {
+	mutexNodes.Lock()
+	infos := make([]NodeInfo, 0, len(nodes))
+	for _, n := range nodes {
+		infos = append(infos, n.NodeInfo)
+	}
+	mutexNodes.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func getAgent(name string) *Agent {
+	mutexNodes.Lock()
+	defer mutexNodes.Unlock()
+
+	n := nodes[name]
+	if n == nil {
+		return nil
+	}
+	return n.agents[0]
+}
+
+// two nodes dialing each other share more than one link, the node is
+// joined with the first link and left with the last one
+func addAgent(a *Agent) {
+	mutexNodes.Lock()
+	n := nodes[a.node.Name]
+	joined := n == nil
+	if joined {
+		n = &node{NodeInfo: a.node}
+		nodes[a.node.Name] = n
+	}
+	n.agents = append(n.agents, a)
+	mutexNodes.Unlock()
+
+	if joined {
+		log.Release("cluster node %v (%v) joined", a.node.Name, a.node.Role)
+		joinRing(a.node.Name, a.node.Role)
+		notify("NodeJoin", a.node)
+	}
+}
+
+func removeAgent(a *Agent) {
+	mutexNodes.Lock()
+	n := nodes[a.node.Name]
+	if n == nil {
+		mutexNodes.Unlock()
+		return
+	}
+	for i, _a := range n.agents {
+		if _a == a {
+			n.agents = append(n.agents[:i], n.agents[i+1:]...)
+			break
+		}
+	}
+	left := len(n.agents) == 0
+	if left {
+		delete(nodes, a.node.Name)
+	}
+	mutexNodes.Unlock()
+
+	if left {
+		log.Release("cluster node %v (%v) left", a.node.Name, a.node.Role)
+		// a link to the local node itself
+		if !isLocal(a.node) {
+			leaveRing(a.node.Name, a.node.Role)
+		}
+		closeSessions(a.node.Name)
+		notify("NodeLeave", a.node)
+	}
+}
+
+// never block the link, the drop is dead-lettered by the server
+func notify(id string, info NodeInfo) {
+	for _, s := range watchers {
+		err := s.TryGo(id, info.Name, info.Role)
+		if err != nil {
+			log.Error("%v of node %v to %v dropped: %v", id, info.Name, s.Name, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"sync"
+
+	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+type publishMsg struct {
+	Topic string
+	Args  []interface{}
+	Trace string
+}
+
+type subscriber struct {
+	s  *chanrpc.Server
+	id interface{}
+}
+
+var (
+	// topic -> local subscribers
+	mutexTopics sync.RWMutex
+	topics      = make(map[string][]subscriber)
+)
+
+// Subscribe delivers the messages published to the topic through
+// s.TryGo(id, args...), the message is dropped if the queue is full.
+// goroutine safe
+func Subscribe(topic string, s *chanrpc.Server, id interface{}) {
+	mutexTopics.Lock()
+	defer mutexTopics.Unlock()
+
+	for _, sub := range topics[topic] {
+		if sub.s == s && sub.id == id {
+			return
+		}
+	}
+	topics[topic] = append(topics[topic], subscriber{s, id})
+}
+
+// goroutine safe
+func Unsubscribe(topic string, s *chanrpc.Server, id interface{}) {
+	mutexTopics.Lock()
+	defer mutexTopics.Unlock()
+
+	subs := topics[topic]
+	for i, sub := range subs {
+		if sub.s == s && sub.id == id {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(topics, topic)
+	} else {
+		topics[topic] = subs
+	}
+}
+
+// Publish delivers the message at most once to every subscriber of the
+// topic, the message is sent once to each node and fanned out there.
+// goroutine safe
+func Publish(topic string, args ...interface{}) {
+	deliver(topic, args)
+
+	msg := &publishMsg{Topic: topic, Args: args, Trace: log.TraceID()}
+	self := nodeName()
+	mutexNodes.Lock()
+	var agents []*Agent
+	for name, n := range nodes {
+		if name != self {
+			agents = append(agents, n.agents[0])
+		}
+	}
+	mutexNodes.Unlock()
+
+	for _, a := range agents {
+		err := a.writeMsg(msg)
+		if err != nil {
+			log.Error("publish topic %v to node %v error: %v", topic, a.node.Name, err)
+		}
+	}
+}
+
+func deliver(topic string, args []interface{}) {
+	mutexTopics.RLock()
+	subs := topics[topic]
+	mutexTopics.RUnlock()
+
+	// never block the link, the drop is dead-lettered by the server
+	for _, sub := range subs {
+		err := sub.s.TryGo(sub.id, args...)
+		if err != nil {
+			log.Error("topic %v to %v dropped: %v", topic, sub.id, err)
+		}
+	}
+}
+
+func (a *Agent) handlePublish(msg *publishMsg) {
+	if msg.Trace != "" {
+		prev := log.SetTraceID(msg.Trace)
+		defer log.SetTraceID(prev)
+	}
+	deliver(msg.Topic, msg.Args)
+}
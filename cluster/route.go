@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/rufeng18/tinyleaf/conf"
+)
+
+// Ring is a consistent hash ring with virtual nodes
+// goroutine safe
+type Ring struct {
+	mutex    sync.RWMutex
+	replicas int
+	hashes   []uint32
+	owners   map[uint32]string
+	nodes    map[string]struct{}
+}
+
+func NewRing(replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = 1
+	}
+
+	r := new(Ring)
+	r.replicas = replicas
+	r.owners = make(map[uint32]string)
+	r.nodes = make(map[string]struct{})
+	return r
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+func (r *Ring) Add(node string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.nodes[node]; ok {
+		return
+	}
+	r.nodes[node] = struct{}{}
+	r.rebuild()
+}
+
+func (r *Ring) Remove(node string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.nodes[node]; !ok {
+		return
+	}
+	delete(r.nodes, node)
+	r.rebuild()
+}
+
+// the membership changes rarely, so the ring is simply rebuilt
+func (r *Ring) rebuild() {
+	r.hashes = r.hashes[:0]
+	r.owners = make(map[uint32]string)
+	for node := range r.nodes {
+		for i := 0; i < r.replicas; i++ {
+			h := hashKey(node + "#" + strconv.Itoa(i))
+			owner, ok := r.owners[h]
+			if !ok {
+				r.hashes = append(r.hashes, h)
+			}
+			// the owner of a collision must not depend on the map order
+			if !ok || node < owner {
+				r.owners[h] = node
+			}
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Get returns the node owning the key, or "" if the ring is empty
+func (r *Ring) Get(key string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+func (r *Ring) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.nodes)
+}
+
+// role -> ring of the joined nodes
+var (
+	mutexRings sync.Mutex
+	rings      = make(map[string]*Ring)
+)
+
+func getRing(role string) *Ring {
+	mutexRings.Lock()
+	defer mutexRings.Unlock()
+
+	r := rings[role]
+	if r == nil {
+		r = NewRing(conf.VirtualNodes)
+		rings[role] = r
+	}
+	return r
+}
+
+func joinRing(name string, role string) {
+	if name != "" {
+		getRing(role).Add(name)
+	}
+}
+
+func leaveRing(name string, role string) {
+	if name != "" {
+		getRing(role).Remove(name)
+	}
+}
+
+func isLocal(info NodeInfo) bool {
+	return info.Name == nodeName() && info.Role == conf.NodeRole
+}
+
+// Owner returns the node of the role which owns the key (user id, room id,
+// etc.), the owners change as the nodes join and leave.
+// goroutine safe
+func Owner(role string, key interface{}) (string, error) {
+	node := getRing(role).Get(fmt.Sprint(key))
+	if node == "" {
+		return "", fmt.Errorf("no cluster node of role %v", role)
+	}
+	return node, nil
+}
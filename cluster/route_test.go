@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+// node a and node b of the same role agree on the owners
+func TestLocalOwner(t *testing.T) {
+	mutexRings.Lock()
+	saved := rings
+	mutexRings.Unlock()
+	defer func() {
+		mutexRings.Lock()
+		rings = saved
+		mutexRings.Unlock()
+	}()
+
+	owners := func(local string, remote string) map[string]string {
+		mutexRings.Lock()
+		rings = make(map[string]*Ring)
+		mutexRings.Unlock()
+
+		// as Init and the handshake of the remote node
+		joinRing(local, "game")
+		joinRing(remote, "game")
+
+		m := make(map[string]string)
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			owner, err := Owner("game", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m[key] = owner
+		}
+		return m
+	}
+
+	a := owners("a", "b")
+	b := owners("b", "a")
+	count := make(map[string]int)
+	for key, owner := range a {
+		if b[key] != owner {
+			t.Fatalf("key %v: owner %v on a, %v on b", key, owner, b[key])
+		}
+		count[owner]++
+	}
+	if count["a"] == 0 || count["b"] == 0 {
+		t.Fatalf("owners: %v", count)
+	}
+}
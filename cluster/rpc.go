@@ -0,0 +1,364 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+var errNodeClosed = errors.New("cluster node closed")
+
+func (a *Agent) handleRequest(req *requestMsg) {
+	if req.Trace != "" {
+		prev := log.SetTraceID(req.Trace)
+		defer log.SetTraceID(prev)
+	}
+
+	s := servers[req.Server]
+	if s == nil {
+		err := fmt.Errorf("chanrpc server %v not registered", req.Server)
+		if req.Type == callGo {
+			log.Error("%v", err)
+		} else {
+			a.reply(req.Seq, nil, err)
+		}
+		return
+	}
+
+	if req.Type == callGo {
+		// never block the link, the drop is dead-lettered by the server
+		err := s.TryGo(req.ID, req.Args...)
+		if err != nil {
+			log.Error("cluster call %v on %v from node %v dropped: %v", req.ID, req.Server, a.node.Name, err)
+		}
+		return
+	}
+
+	// the call blocks until the server goroutine executes it, a wedged
+	// server must not pile up goroutines
+	select {
+	case a.calls <- struct{}{}:
+	default:
+		a.reply(req.Seq, nil, fmt.Errorf("too many calls from node %v", a.node.Name))
+		return
+	}
+
+	go func() {
+		log.SetTraceID(req.Trace)
+		defer log.SetTraceID("")
+
+		// the caller gives up at its deadline
+		var deadline time.Time
+		if req.Timeout > 0 {
+			deadline = time.Now().Add(time.Duration(req.Timeout))
+		}
+		ctx, cancel := deadlineContext(deadline)
+		defer cancel()
+
+		ret, err := execCall(ctx, s, req.Type, req.ID, req.Args)
+		<-a.calls
+		if err == context.DeadlineExceeded {
+			// the caller expires the call by itself
+			return
+		}
+		a.reply(req.Seq, ret, err)
+	}()
+}
+
+func execCall(ctx context.Context, s *chanrpc.Server, t uint8, id interface{}, args []interface{}) (interface{}, error) {
+	switch t {
+	case call0:
+		return nil, s.Call0Context(ctx, id, args...)
+	case call1:
+		return s.Call1Context(ctx, id, args...)
+	case callN:
+		return s.CallNContext(ctx, id, args...)
+	default:
+		return nil, fmt.Errorf("invalid call type %v", t)
+	}
+}
+
+func (a *Agent) reply(seq uint32, ret interface{}, err error) {
+	resp := &responseMsg{Seq: seq, Ret: ret}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+
+	err = a.writeMsg(resp)
+	if err != nil {
+		log.Error("reply to node %v error: %v", a.node.Name, err)
+		a.writeMsg(&responseMsg{Seq: seq, Err: err.Error()})
+	}
+}
+
+func (a *Agent) handleResponse(resp *responseMsg) {
+	pc := a.take(resp.Seq)
+	if pc == nil {
+		log.Debug("response %v from node %v not expected", resp.Seq, a.node.Name)
+		return
+	}
+
+	var err error
+	if resp.Err != "" {
+		err = errors.New(resp.Err)
+	}
+	pc.done(resp.Ret, err)
+}
+
+// done is nil for callGo, the sequence identifies the call for cancel. done
+// gets context.DeadlineExceeded at the deadline unless it is zero.
+func (a *Agent) call(t uint8, server string, id interface{}, args []interface{}, deadline time.Time, done func(interface{}, error)) (uint32, error) {
+	req := &requestMsg{Type: t, Server: server, ID: id, Args: args, Trace: log.TraceID()}
+	if !deadline.IsZero() {
+		req.Timeout = int64(time.Until(deadline))
+		if req.Timeout <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+	}
+
+	a.mutexPending.Lock()
+	if a.closeFlag {
+		a.mutexPending.Unlock()
+		return 0, errNodeClosed
+	}
+	if done != nil {
+		a.seq++
+		req.Seq = a.seq
+		pc := &pendingCall{done: done}
+		if req.Timeout > 0 {
+			seq := req.Seq
+			pc.timer = time.AfterFunc(time.Duration(req.Timeout), func() {
+				a.expire(seq)
+			})
+		}
+		a.pending[req.Seq] = pc
+	}
+	a.mutexPending.Unlock()
+
+	err := a.writeMsg(req)
+	if err != nil && done != nil {
+		a.cancel(req.Seq)
+	}
+	return req.Seq, err
+}
+
+// take removes the call, nil if it is done already
+func (a *Agent) take(seq uint32) *pendingCall {
+	a.mutexPending.Lock()
+	pc := a.pending[seq]
+	delete(a.pending, seq)
+	a.mutexPending.Unlock()
+
+	if pc != nil && pc.timer != nil {
+		pc.timer.Stop()
+	}
+	return pc
+}
+
+// the reply to the call is ignored
+func (a *Agent) cancel(seq uint32) {
+	a.take(seq)
+}
+
+func (a *Agent) expire(seq uint32) {
+	pc := a.take(seq)
+	if pc != nil {
+		pc.done(nil, context.DeadlineExceeded)
+	}
+}
+
+func call(t uint8, node string, server string, id interface{}, args []interface{}, deadline time.Time, done func(interface{}, error)) {
+	// the local node may own the key
+	if isLocalNode(node) {
+		s := servers[server]
+		if s == nil {
+			done(nil, fmt.Errorf("chanrpc server %v not registered", server))
+			return
+		}
+		go log.WithTraceID(log.TraceID(), func() {
+			ctx, cancel := deadlineContext(deadline)
+			defer cancel()
+			done(execCall(ctx, s, t, id, args))
+		})()
+		return
+	}
+
+	a := getAgent(node)
+	if a == nil {
+		done(nil, fmt.Errorf("cluster node %v not connected", node))
+		return
+	}
+
+	_, err := a.call(t, server, id, args, deadline, done)
+	if err != nil {
+		done(nil, err)
+	}
+}
+
+// no deadline if it is zero
+func deadlineContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// the local node is called directly, unless it has a link to itself
+func isLocalNode(node string) bool {
+	return node == nodeName() && getAgent(node) == nil
+}
+
+func syncCall(ctx context.Context, t uint8, node string, server string, id interface{}, args []interface{}) (interface{}, error) {
+	if isLocalNode(node) {
+		s := servers[server]
+		if s == nil {
+			return nil, fmt.Errorf("chanrpc server %v not registered", server)
+		}
+		return execCall(ctx, s, t, id, args)
+	}
+
+	a := getAgent(node)
+	if a == nil {
+		return nil, fmt.Errorf("cluster node %v not connected", node)
+	}
+
+	type result struct {
+		ret interface{}
+		err error
+	}
+	chanRet := make(chan result, 1)
+	deadline, _ := ctx.Deadline()
+	seq, err := a.call(t, server, id, args, deadline, func(ret interface{}, err error) {
+		chanRet <- result{ret, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-chanRet:
+		return r.ret, r.err
+	case <-ctx.Done():
+		a.cancel(seq)
+		return nil, ctx.Err()
+	}
+}
+
+// goroutine safe
+func Go(node string, server string, id interface{}, args ...interface{}) {
+	if isLocalNode(node) {
+		s := servers[server]
+		if s == nil {
+			log.Error("chanrpc server %v not registered", server)
+			return
+		}
+		s.Go(id, args...)
+		return
+	}
+
+	a := getAgent(node)
+	if a == nil {
+		log.Error("cluster node %v not connected", node)
+		return
+	}
+
+	_, err := a.call(callGo, server, id, args, time.Time{}, nil)
+	if err != nil {
+		log.Error("cluster call %v on node %v error: %v", id, node, err)
+	}
+}
+
+// goroutine safe
+func Call0(node string, server string, id interface{}, args ...interface{}) error {
+	return Call0Context(context.Background(), node, server, id, args...)
+}
+
+// goroutine safe
+func Call1(node string, server string, id interface{}, args ...interface{}) (interface{}, error) {
+	return Call1Context(context.Background(), node, server, id, args...)
+}
+
+// goroutine safe
+func CallN(node string, server string, id interface{}, args ...interface{}) ([]interface{}, error) {
+	return CallNContext(context.Background(), node, server, id, args...)
+}
+
+// Call0Context is Call0 with a deadline, the late reply is ignored
+// goroutine safe
+func Call0Context(ctx context.Context, node string, server string, id interface{}, args ...interface{}) error {
+	_, err := syncCall(ctx, call0, node, server, id, args)
+	return err
+}
+
+// goroutine safe
+func Call1Context(ctx context.Context, node string, server string, id interface{}, args ...interface{}) (interface{}, error) {
+	return syncCall(ctx, call1, node, server, id, args)
+}
+
+// goroutine safe
+func CallNContext(ctx context.Context, node string, server string, id interface{}, args ...interface{}) ([]interface{}, error) {
+	ret, err := syncCall(ctx, callN, node, server, id, args)
+	if ret == nil {
+		return nil, err
+	}
+	return ret.([]interface{}), err
+}
+
+// AsynCall calls a chanrpc server on the node, the callback (the last
+// argument) is executed on the goroutine that owns client. The call fails
+// with context.DeadlineExceeded after conf.CallTimeout.
+// goroutine not safe
+func AsynCall(client *chanrpc.Client, node string, server string, id interface{}, _args ...interface{}) {
+	if len(_args) < 1 {
+		panic("callback function not found")
+	}
+
+	args := _args[:len(_args)-1]
+	cb := _args[len(_args)-1]
+
+	var t uint8
+	switch cb.(type) {
+	case func(error):
+		t = call0
+	case func(interface{}, error):
+		t = call1
+	case func([]interface{}, error):
+		t = callN
+	default:
+		panic("definition of callback function is invalid")
+	}
+
+	client.ExtAsynCall(asynExec(t, node, server, id, args), cb)
+}
+
+// AsynGather calls a chanrpc server on every node with the same arguments,
+// the function must return one value (as Call1). The callback is executed
+// once with all the results, on the goroutine that owns client.
+// goroutine not safe
+func AsynGather(client *chanrpc.Client, nodes []string, opts chanrpc.GatherOptions, server string, id interface{}, args []interface{}, cb func(results []chanrpc.GatherResult)) {
+	execs := make([]func(done func(interface{}, error)), len(nodes))
+	for i, node := range nodes {
+		execs[i] = asynExec(call1, node, server, id, args)
+	}
+	client.ExtAsynGather(execs, opts, cb)
+}
+
+// the call fails after conf.CallTimeout from when it is sent
+func asynExec(t uint8, node string, server string, id interface{}, args []interface{}) func(done func(interface{}, error)) {
+	// the call may be sent later, by Flush
+	traceID := log.TraceID()
+	return func(done func(interface{}, error)) {
+		var deadline time.Time
+		if conf.CallTimeout > 0 {
+			deadline = time.Now().Add(conf.CallTimeout)
+		}
+		log.WithTraceID(traceID, func() {
+			call(t, node, server, id, args, deadline, done)
+		})()
+	}
+}
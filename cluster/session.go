@@ -0,0 +1,257 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+// forward ops
+const (
+	sessionOpen = iota
+	sessionData
+	sessionClose
+)
+
+// relay ops
+const (
+	relayData = iota
+	relayVerify
+	relayClose
+)
+
+// gate -> backend
+type forwardMsg struct {
+	ID    uint64
+	Op    uint8
+	Addr  string
+	Data  []byte
+	Trace string
+}
+
+// backend -> gate
+type relayMsg struct {
+	ID   uint64
+	Op   uint8
+	Data [][]byte
+}
+
+// the client connection of a gate, network.Conn satisfies it
+type SessionConn interface {
+	WriteMsg(args ...[]byte) error
+	Close()
+	Verify()
+}
+
+// the handler of the sessions forwarded to a backend, it is called on the
+// goroutine of the cluster link
+type SessionHandler interface {
+	OnSessionOpen(s *Session)
+	OnSessionMsg(s *Session, data []byte)
+	OnSessionClose(s *Session)
+}
+
+// Session is a client connection forwarded to a backend by a gate node
+type Session struct {
+	Node string // the gate node
+	ID   uint64
+	Addr string // the client address
+}
+
+type gateSession struct {
+	node string
+	conn SessionConn
+}
+
+type sessionKey struct {
+	node string
+	id   uint64
+}
+
+var (
+	// gate side
+	mutexGateSessions sync.Mutex
+	lastSessionID     uint64
+	gateSessions      = make(map[uint64]*gateSession)
+
+	// backend side
+	sessionHandler       SessionHandler
+	mutexBackendSessions sync.Mutex
+	backendSessions      = make(map[sessionKey]*Session)
+)
+
+// you must call the function before calling cluster.Init
+// goroutine not safe
+func SetSessionHandler(h SessionHandler) {
+	sessionHandler = h
+}
+
+// OpenSession binds the client connection to the backend node and returns
+// the session id used to forward its messages.
+// goroutine safe
+func OpenSession(node string, addr string, conn SessionConn) (uint64, error) {
+	a := getAgent(node)
+	if a == nil {
+		return 0, fmt.Errorf("cluster node %v not connected", node)
+	}
+
+	mutexGateSessions.Lock()
+	lastSessionID++
+	id := lastSessionID
+	gateSessions[id] = &gateSession{node: node, conn: conn}
+	mutexGateSessions.Unlock()
+
+	err := a.writeMsg(&forwardMsg{ID: id, Op: sessionOpen, Addr: addr})
+	if err != nil {
+		mutexGateSessions.Lock()
+		delete(gateSessions, id)
+		mutexGateSessions.Unlock()
+		return 0, err
+	}
+	return id, nil
+}
+
+// goroutine safe
+func ForwardMsg(id uint64, data []byte) error {
+	mutexGateSessions.Lock()
+	gs := gateSessions[id]
+	mutexGateSessions.Unlock()
+	if gs == nil {
+		return fmt.Errorf("session %v not found", id)
+	}
+
+	a := getAgent(gs.node)
+	if a == nil {
+		return fmt.Errorf("cluster node %v not connected", gs.node)
+	}
+	return a.writeMsg(&forwardMsg{ID: id, Op: sessionData, Data: data, Trace: log.TraceID()})
+}
+
+// goroutine safe
+func CloseSession(id uint64) {
+	mutexGateSessions.Lock()
+	gs := gateSessions[id]
+	delete(gateSessions, id)
+	mutexGateSessions.Unlock()
+	if gs == nil {
+		return
+	}
+
+	a := getAgent(gs.node)
+	if a != nil {
+		a.writeMsg(&forwardMsg{ID: id, Op: sessionClose})
+	}
+}
+
+// goroutine safe
+func (s *Session) WriteMsg(args ...[]byte) error {
+	return s.relay(&relayMsg{ID: s.ID, Op: relayData, Data: args})
+}
+
+// goroutine safe
+func (s *Session) Verify() {
+	s.relay(&relayMsg{ID: s.ID, Op: relayVerify})
+}
+
+// Close asks the gate to close the client connection.
+// goroutine safe
+func (s *Session) Close() {
+	s.relay(&relayMsg{ID: s.ID, Op: relayClose})
+}
+
+func (s *Session) relay(msg *relayMsg) error {
+	a := getAgent(s.Node)
+	if a == nil {
+		return fmt.Errorf("cluster node %v not connected", s.Node)
+	}
+	return a.writeMsg(msg)
+}
+
+func (a *Agent) handleForward(msg *forwardMsg) {
+	if sessionHandler == nil {
+		log.Error("session handler not set, message from node %v dropped", a.node.Name)
+		return
+	}
+	if msg.Trace != "" {
+		prev := log.SetTraceID(msg.Trace)
+		defer log.SetTraceID(prev)
+	}
+
+	key := sessionKey{a.node.Name, msg.ID}
+	switch msg.Op {
+	case sessionOpen:
+		s := &Session{Node: a.node.Name, ID: msg.ID, Addr: msg.Addr}
+		mutexBackendSessions.Lock()
+		backendSessions[key] = s
+		mutexBackendSessions.Unlock()
+		sessionHandler.OnSessionOpen(s)
+	case sessionData:
+		mutexBackendSessions.Lock()
+		s := backendSessions[key]
+		mutexBackendSessions.Unlock()
+		if s != nil {
+			sessionHandler.OnSessionMsg(s, msg.Data)
+		}
+	case sessionClose:
+		mutexBackendSessions.Lock()
+		s := backendSessions[key]
+		delete(backendSessions, key)
+		mutexBackendSessions.Unlock()
+		if s != nil {
+			sessionHandler.OnSessionClose(s)
+		}
+	}
+}
+
+func (a *Agent) handleRelay(msg *relayMsg) {
+	mutexGateSessions.Lock()
+	gs := gateSessions[msg.ID]
+	mutexGateSessions.Unlock()
+	if gs == nil {
+		return
+	}
+
+	switch msg.Op {
+	case relayData:
+		err := gs.conn.WriteMsg(msg.Data...)
+		if err != nil {
+			log.Error("relay message to session %v error: %v", msg.ID, err)
+		}
+	case relayVerify:
+		gs.conn.Verify()
+	case relayClose:
+		gs.conn.Close()
+	}
+}
+
+// the sessions are gone with the node
+func closeSessions(node string) {
+	var conns []SessionConn
+	mutexGateSessions.Lock()
+	for id, gs := range gateSessions {
+		if gs.node == node {
+			conns = append(conns, gs.conn)
+			delete(gateSessions, id)
+		}
+	}
+	mutexGateSessions.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	var sessions []*Session
+	mutexBackendSessions.Lock()
+	for key, s := range backendSessions {
+		if key.node == node {
+			sessions = append(sessions, s)
+			delete(backendSessions, key)
+		}
+	}
+	mutexBackendSessions.Unlock()
+
+	for _, s := range sessions {
+		sessionHandler.OnSessionClose(s)
+	}
+}
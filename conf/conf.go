@@ -9,6 +9,18 @@ var (
 	// log
 	LogLevel string
 	LogPath  string
+	// bind trace ids to goroutines, see log.SetTraceID, it costs a stack
+	// walk per call and message when set
+	LogTrace bool
+
+	// module, the shutdown deadlines, 0 for no limit
+	ShutdownTimeout       = 30 * time.Second // all the modules
+	ModuleShutdownTimeout = 10 * time.Second // each module
+	// the config reload of each module, 0 for no limit
+	ModuleReloadTimeout = 10 * time.Second
+
+	// chanrpc, log the calls running longer, 0 to disable
+	SlowCallThreshold time.Duration
 
 	// console
 	ConsolePort   int
@@ -16,7 +28,17 @@ var (
 	ProfilePath   string
 
 	// cluster
-	ListenAddr      string
-	ConnAddrs       []string
-	PendingWriteNum int
+	ListenAddr        string
+	ConnAddrs         []string
+	PendingWriteNum   int
+	NodeName          string // default to ListenAddr
+	NodeRole          string
+	HeartbeatInterval = 5 * time.Second
+	HeartbeatTimeout  = 15 * time.Second
+	VirtualNodes      = 160 // per node on the hash ring
+	// the deadline of the asynchronous calls to the other nodes, 0 for no
+	// limit
+	CallTimeout = 30 * time.Second
+	// the calls from a node served at once, the others fail at once
+	MaxNodeCalls = 1000
 )
@@ -5,17 +5,21 @@ import (
 	"os"
 	"path"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	"github.com/rufeng18/tinyleaf/chanrpc"
 	"github.com/rufeng18/tinyleaf/conf"
 	"github.com/rufeng18/tinyleaf/log"
+	"github.com/rufeng18/tinyleaf/timer"
 )
 
 var commands = []Command{
 	new(CommandHelp),
 	new(CommandCPUProf),
 	new(CommandProf),
+	new(CommandChanRPC),
+	new(CommandCron),
 }
 
 type Command interface {
@@ -77,6 +81,38 @@ func Register(name string, help string, f interface{}, server *chanrpc.Server) {
 	commands = append(commands, c)
 }
 
+type FuncCommand struct {
+	_name string
+	_help string
+	f     func(args []string) string
+}
+
+func (c *FuncCommand) name() string {
+	return c._name
+}
+
+func (c *FuncCommand) help() string {
+	return c._help
+}
+
+func (c *FuncCommand) run(args []string) string {
+	return c.f(args)
+}
+
+// RegisterFunc registers a command run on the console goroutine, f must be
+// goroutine safe
+// you must call the function before calling console.Init
+// goroutine not safe
+func RegisterFunc(name string, help string, f func(args []string) string) {
+	for _, c := range commands {
+		if c.name() == name {
+			log.Fatal("command %v is already registered", name)
+		}
+	}
+
+	commands = append(commands, &FuncCommand{_name: name, _help: help, f: f})
+}
+
 // help
 type CommandHelp struct{}
 
@@ -214,3 +250,66 @@ func (c *CommandProf) run(args []string) string {
 
 	return fn
 }
+
+// chanrpc
+type CommandChanRPC struct{}
+
+func (c *CommandChanRPC) name() string {
+	return "chanrpc"
+}
+
+func (c *CommandChanRPC) help() string {
+	return "queue depth and call latency of the chanrpc servers"
+}
+
+func (c *CommandChanRPC) run([]string) string {
+	var output string
+	for i, s := range chanrpc.Servers() {
+		if i > 0 {
+			output += "\r\n"
+		}
+		output += s.Stats().String()
+	}
+	if output == "" {
+		return "no named chanrpc server"
+	}
+
+	return output
+}
+
+// cron
+type CommandCron struct{}
+
+func (c *CommandCron) name() string {
+	return "cron"
+}
+
+func (c *CommandCron) help() string {
+	return "the next run times of a cron expression"
+}
+
+func (c *CommandCron) usage() string {
+	return "cron shows the next 5 run times of a cron expression\r\n\r\n" +
+		"Usage: cron expr\r\n" +
+		"  expr - such as TZ=Asia/Shanghai 0 0 * * * or @every 5m"
+}
+
+func (c *CommandCron) run(args []string) string {
+	if len(args) == 0 {
+		return c.usage()
+	}
+
+	cronExpr, err := timer.NewCronExpr(strings.Join(args, " "))
+	if err != nil {
+		return err.Error()
+	}
+	var output []string
+	for _, t := range cronExpr.NextN(time.Now(), 5) {
+		output = append(output, t.String())
+	}
+	if len(output) == 0 {
+		return "never"
+	}
+
+	return strings.Join(output, "\r\n")
+}
@@ -0,0 +1,119 @@
+package gate
+
+import (
+	"reflect"
+
+	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/cluster"
+	"github.com/rufeng18/tinyleaf/log"
+	"github.com/rufeng18/tinyleaf/network"
+	"github.com/rufeng18/tinyleaf/util"
+)
+
+// Backend serves the clients forwarded by the gate nodes (see
+// Gate.BackendNode), each session is seen as an Agent so the handlers work
+// the same on both sides. Install it with cluster.SetSessionHandler.
+// The handlers run on the cluster link, so a full AgentChanRPC or router
+// closes the session instead of blocking; Processor should implement
+// network.TryRouter.
+type Backend struct {
+	Processor    network.Processor
+	AgentChanRPC *chanrpc.Server
+	agents       util.Map
+}
+
+func (b *Backend) OnSessionOpen(s *cluster.Session) {
+	a := &sessionAgent{session: s, backend: b}
+	if b.AgentChanRPC != nil {
+		err := b.AgentChanRPC.TryGo("NewAgent", a)
+		if err != nil {
+			log.Error("session %v from node %v dropped: %v", s.ID, s.Node, err)
+			s.Close()
+			return
+		}
+	}
+	b.agents.Set(s, a)
+}
+
+func (b *Backend) OnSessionMsg(s *cluster.Session, data []byte) {
+	a, ok := b.agents.Get(s).(*sessionAgent)
+	if !ok || b.Processor == nil {
+		return
+	}
+
+	msg, err := b.Processor.Unmarshal(data)
+	if err != nil {
+		log.Debug("unmarshal message error: %v", err)
+		s.Close()
+		return
+	}
+	if r, ok := b.Processor.(network.TryRouter); ok {
+		err = r.TryRoute(msg, a)
+	} else {
+		err = b.Processor.Route(msg, a)
+	}
+	if err != nil {
+		log.Debug("route message error: %v", err)
+		s.Close()
+	}
+}
+
+func (b *Backend) OnSessionClose(s *cluster.Session) {
+	a, ok := b.agents.Get(s).(*sessionAgent)
+	if !ok {
+		return
+	}
+
+	b.agents.Del(s)
+	if b.AgentChanRPC != nil {
+		// dead-lettered by AgentChanRPC
+		err := b.AgentChanRPC.TryGo("CloseAgent", a)
+		if err != nil {
+			log.Error("close of session %v from node %v dropped: %v", s.ID, s.Node, err)
+		}
+	}
+}
+
+type sessionAgent struct {
+	session  *cluster.Session
+	backend  *Backend
+	userData interface{}
+}
+
+func (a *sessionAgent) WriteMsg(msg interface{}) {
+	if a.backend.Processor != nil {
+		data, err := a.backend.Processor.Marshal(msg)
+		if err != nil {
+			log.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+			return
+		}
+		err = a.session.WriteMsg(data...)
+		if err != nil {
+			log.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+		}
+	}
+}
+
+func (a *sessionAgent) Close() {
+	a.session.Close()
+}
+
+func (a *sessionAgent) Destroy() {
+	a.session.Close()
+}
+
+func (a *sessionAgent) UserData() interface{} {
+	return a.userData
+}
+
+func (a *sessionAgent) SetUserData(data interface{}) {
+	a.userData = data
+}
+
+func (a *sessionAgent) Verify() {
+	a.session.Verify()
+}
+
+func (a *sessionAgent) GetClientIP() string {
+	return a.session.Addr
+}
@@ -1,20 +1,25 @@
 package gate
 
 import (
+	"context"
+	"net"
 	"reflect"
 	"time"
 
 	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/cluster"
+	"github.com/rufeng18/tinyleaf/conf"
 	"github.com/rufeng18/tinyleaf/log"
 	"github.com/rufeng18/tinyleaf/network"
 )
 
 type Gate struct {
-	MaxConnNum      int
-	PendingWriteNum int
-	MaxMsgLen       uint32
-	Processor       network.Processor
-	AgentChanRPC    *chanrpc.Server
+	MaxConnNum        int
+	PendingWriteNum   int
+	MaxMsgLen         uint32
+	Processor         network.Processor
+	AgentChanRPC      *chanrpc.Server
+	CloseAgentTimeout time.Duration
 
 	// websocket
 	WSAddr      string
@@ -26,9 +31,19 @@ type Gate struct {
 	LenExtHeadLen int
 	LittleEndian  bool
 	Encrypt       bool
+
+	// cluster, forward the client messages to the backend node
+	// instead of routing them by Processor
+	BackendNode string
+	BackendRole string // the backend node owning the client ip
 }
 
 func (gate *Gate) Run(closeSig chan bool) {
+	if gate.CloseAgentTimeout <= 0 {
+		gate.CloseAgentTimeout = 10 * time.Second
+		log.Release("invalid CloseAgentTimeout, reset to %v", gate.CloseAgentTimeout)
+	}
+
 	var wsServer *network.WSServer
 	if gate.WSAddr != "" {
 		wsServer = new(network.WSServer)
@@ -87,15 +102,27 @@ type agent struct {
 	conn     network.Conn
 	gate     *Gate
 	userData interface{}
+	session  uint64
 }
 
+// every message starts a trace with conf.LogTrace
 func (a *agent) Run() {
+	defer log.SetTraceID("")
+
+	if a.gate.BackendNode != "" || a.gate.BackendRole != "" {
+		a.forward()
+		return
+	}
+
 	for {
 		data, err := a.conn.ReadMsg()
 		if err != nil {
 			log.Debug("read message: %v", err)
 			break
 		}
+		if conf.LogTrace {
+			log.SetTraceID(log.NewTraceID())
+		}
 
 		if a.gate.Processor != nil {
 			msg, err := a.gate.Processor.Unmarshal(data)
@@ -112,9 +139,51 @@ func (a *agent) Run() {
 	}
 }
 
+func (a *agent) forward() {
+	node := a.gate.BackendNode
+	if node == "" {
+		host, _, _ := net.SplitHostPort(a.GetClientIP())
+		var err error
+		node, err = cluster.Owner(a.gate.BackendRole, host)
+		if err != nil {
+			log.Debug("select backend error: %v", err)
+			return
+		}
+	}
+
+	var err error
+	a.session, err = cluster.OpenSession(node, a.GetClientIP(), a.conn)
+	if err != nil {
+		log.Debug("open session error: %v", err)
+		return
+	}
+
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			log.Debug("read message: %v", err)
+			break
+		}
+		if conf.LogTrace {
+			log.SetTraceID(log.NewTraceID())
+		}
+
+		err = cluster.ForwardMsg(a.session, data)
+		if err != nil {
+			log.Debug("forward message error: %v", err)
+			break
+		}
+	}
+}
+
 func (a *agent) OnClose() {
+	if a.session != 0 {
+		cluster.CloseSession(a.session)
+	}
 	if a.gate.AgentChanRPC != nil {
-		err := a.gate.AgentChanRPC.Call0("CloseAgent", a)
+		ctx, cancel := context.WithTimeout(context.Background(), a.gate.CloseAgentTimeout)
+		defer cancel()
+		err := a.gate.AgentChanRPC.Call0Context(ctx, "CloseAgent", a)
 		if err != nil {
 			log.Error("chanrpc error: %v", err)
 		}
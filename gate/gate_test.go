@@ -0,0 +1,177 @@
+package gate_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/cluster"
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/gate"
+	"github.com/rufeng18/tinyleaf/network/json"
+)
+
+const (
+	nodeAddr = "127.0.0.1:33376"
+	gateAddr = "127.0.0.1:33377"
+	node     = "game1"
+)
+
+type Hello struct {
+	Name string
+}
+
+// the node is both the gate and the backend, through a link to itself
+func TestForward(t *testing.T) {
+	processor := json.NewProcessor()
+	processor.Register(&Hello{})
+
+	opened := make(chan gate.Agent, 1)
+	closed := make(chan gate.Agent, 1)
+	agents := chanrpc.NewServer(10)
+	agents.Register("NewAgent", func(args []interface{}) {
+		opened <- args[0].(gate.Agent)
+	})
+	agents.Register("CloseAgent", func(args []interface{}) {
+		closed <- args[0].(gate.Agent)
+	})
+	agents.Register(reflect.TypeOf(&Hello{}), func(args []interface{}) {
+		m := args[0].(*Hello)
+		a := args[1].(gate.Agent)
+		a.WriteMsg(&Hello{Name: "hello " + m.Name})
+	})
+	processor.SetRouter(&Hello{}, agents)
+	go func() {
+		for ci := range agents.ChanCall {
+			agents.Exec(ci)
+		}
+	}()
+
+	stop := start(t, &gate.Backend{Processor: processor, AgentChanRPC: agents})
+	defer stop()
+	conn := dial(t)
+	defer conn.Close()
+
+	var a gate.Agent
+	select {
+	case a = <-opened:
+	case <-time.After(time.Second):
+		t.Fatal("NewAgent not called")
+	}
+	if a.GetClientIP() != conn.LocalAddr().String() {
+		t.Fatalf("GetClientIP: %v", a.GetClientIP())
+	}
+
+	writeFrame(t, conn, `{"Hello":{"Name":"leaf"}}`)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if reply := readFrame(t, conn); reply != `{"Hello":{"Name":"hello leaf"}}` {
+		t.Fatalf("reply: %v", reply)
+	}
+
+	conn.Close()
+	select {
+	case c := <-closed:
+		if c != a {
+			t.Fatal("CloseAgent: another agent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CloseAgent not called")
+	}
+}
+
+// a full AgentChanRPC closes the session instead of blocking the link
+func TestForwardDrop(t *testing.T) {
+	agents := chanrpc.NewServer(0)
+	agents.Register("NewAgent", func(args []interface{}) {})
+	agents.Register("CloseAgent", func(args []interface{}) {})
+
+	stop := start(t, &gate.Backend{Processor: json.NewProcessor(), AgentChanRPC: agents})
+	defer stop()
+	conn := dial(t)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read: %v", err)
+	}
+}
+
+// start runs the cluster node and the gate forwarding to it
+func start(t *testing.T, backend *gate.Backend) (stop func()) {
+	conf.ListenAddr = nodeAddr
+	conf.ConnAddrs = []string{nodeAddr}
+	conf.PendingWriteNum = 100
+	conf.NodeName = node
+	conf.NodeRole = "game"
+
+	cluster.SetSessionHandler(backend)
+	cluster.Init()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cluster.Nodes()) == 0 {
+		if time.Now().After(deadline) {
+			cluster.Destroy()
+			t.Fatal("node not joined")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	g := &gate.Gate{
+		MaxConnNum:      10,
+		PendingWriteNum: 10,
+		MaxMsgLen:       4096,
+		TCPAddr:         gateAddr,
+		LenMsgLen:       2,
+		BackendNode:     node,
+	}
+	closeSig := make(chan bool, 1)
+	exit := make(chan bool)
+	go func() {
+		g.Run(closeSig)
+		exit <- true
+	}()
+
+	return func() {
+		closeSig <- true
+		<-exit
+		cluster.Destroy()
+	}
+}
+
+func dial(t *testing.T) net.Conn {
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", gateAddr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeFrame(t *testing.T, conn net.Conn, data string) {
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(t *testing.T, conn net.Conn) string {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(head[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
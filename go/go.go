@@ -33,10 +33,16 @@ func New(l int) *Go {
 	return g
 }
 
+// f and cb run with the trace id of the caller
 func (g *Go) Go(f func(), cb func()) {
 	g.pendingGo++
+	traceID := log.TraceID()
+	cb = log.WithTraceID(traceID, cb)
 
 	go func() {
+		log.SetTraceID(traceID)
+		defer log.SetTraceID("")
+
 		defer func() {
 			g.ChanCb <- cb
 			if r := recover(); r != nil {
@@ -83,6 +89,11 @@ func (g *Go) Idle() bool {
 	return g.pendingGo == 0
 }
 
+// the calls whose callback is not executed
+func (g *Go) Pending() int {
+	return g.pendingGo
+}
+
 func (g *Go) NewLinearContext() *LinearContext {
 	c := new(LinearContext)
 	c.g = g
@@ -92,9 +103,10 @@ func (g *Go) NewLinearContext() *LinearContext {
 
 func (c *LinearContext) Go(f func(), cb func()) {
 	c.g.pendingGo++
+	traceID := log.TraceID()
 
 	c.mutexLinearGo.Lock()
-	c.linearGo.PushBack(&LinearGo{f: f, cb: cb})
+	c.linearGo.PushBack(&LinearGo{f: log.WithTraceID(traceID, f), cb: log.WithTraceID(traceID, cb)})
 	c.mutexLinearGo.Unlock()
 
 	go func() {
@@ -2,6 +2,8 @@ package tinyleaf
 
 import (
 	//"fmt"
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -44,19 +46,51 @@ func Run(mods ...module.Module) {
 	// control the singal
 	ch := make(chan bool, 1)
 	installSignal(ch)
-	<-ch
+	select {
+	case <-ch:
+	case name := <-module.Escalated():
+		log.Release("module %v escalated", name)
+	}
 
 	log.Release("mmoBay server closing down ")
 	console.Destroy()
 	cluster.Destroy()
-	module.Destroy()
+	err := module.Destroy()
+	if err != nil {
+		log.Fatal("%v", err)
+	}
 
 }
 
 func reload() {
 	log.Release("mmoBay server reload config ")
-	module.Reload()
-	logger.SetLoggerLevel(conf.LogLevel)
+	// the reserved section "LogLevel", a string such as "debug", see
+	// module.ConfigSource, is checked before any module is reloaded
+	level := conf.LogLevel
+	err := module.ReloadChecked(func(cfg map[string]json.RawMessage) error {
+		section := cfg["LogLevel"]
+		if section == nil {
+			return nil
+		}
+		var l string
+		err := json.Unmarshal(section, &l)
+		if err == nil {
+			err = log.CheckLevel(l)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid LogLevel section: %v", err)
+		}
+		level = l
+		return nil
+	})
+	if err != nil {
+		log.Error("reload config error: %v", err)
+		return
+	}
+	conf.LogLevel = level
+	if logger != nil {
+		logger.SetLoggerLevel(conf.LogLevel)
+	}
 }
 
 func installSignal(ctrl chan bool) {
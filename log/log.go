@@ -114,6 +114,9 @@ func (logger *Logger) doPrintf(level int, printLevel string, format string, a ..
 		panic("logger closed")
 	}
 
+	if id := TraceID(); id != "" {
+		format = "[" + id + "] " + format
+	}
 	format = printLevel + format
 	logger.baseLogger.Printf(format, a...)
 
@@ -146,6 +149,16 @@ func (logger *Logger) Fatal(format string, a ...interface{}) {
 	logger.doPrintf(fatalLevel, printFatalLevel, format, a...)
 }
 
+// CheckLevel returns an error if strLevel is not a level of New, which
+// SetLoggerLevel ignores
+func CheckLevel(strLevel string) error {
+	switch strings.ToLower(strLevel) {
+	case "debug", "release", "warning", "info", "error", "fatal":
+		return nil
+	}
+	return errors.New("unknown level: " + strLevel)
+}
+
 func (logger *Logger) SetLoggerLevel(strLevel string) {
 	// level
 	var level int
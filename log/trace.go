@@ -0,0 +1,91 @@
+package log
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rufeng18/tinyleaf/conf"
+)
+
+// the trace ids are bound to goroutines with conf.LogTrace, the goroutine
+// handling a request binds its id and every log call made there includes it.
+// A goroutine only writes its own entry.
+var (
+	traces    sync.Map // goroutine id -> trace id
+	numTraces int32
+)
+
+func goid() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	// goroutine 18 [running]:
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// NewTraceID returns a random id
+func NewTraceID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// TraceID returns the id bound to the current goroutine, "" if none or
+// without conf.LogTrace
+func TraceID() string {
+	if !conf.LogTrace || atomic.LoadInt32(&numTraces) == 0 {
+		return ""
+	}
+
+	if id, ok := traces.Load(goid()); ok {
+		return id.(string)
+	}
+	return ""
+}
+
+// SetTraceID binds the id to the current goroutine and returns the previous
+// one, "" unbinds it. A goroutine must unbind its id before it exits. It does
+// nothing without conf.LogTrace.
+func SetTraceID(id string) (prev string) {
+	if !conf.LogTrace || id == "" && atomic.LoadInt32(&numTraces) == 0 {
+		return ""
+	}
+
+	gid := goid()
+	if v, ok := traces.Load(gid); ok {
+		prev = v.(string)
+	}
+	if id == "" {
+		if prev != "" {
+			traces.Delete(gid)
+			atomic.AddInt32(&numTraces, -1)
+		}
+		return
+	}
+	if prev == "" {
+		atomic.AddInt32(&numTraces, 1)
+	}
+	traces.Store(gid, id)
+	return
+}
+
+// WithTraceID returns f which runs with the id bound, or f itself if id is ""
+func WithTraceID(id string, f func()) func() {
+	if id == "" || f == nil {
+		return f
+	}
+	return func() {
+		prev := SetTraceID(id)
+		defer SetTraceID(prev)
+		f()
+	}
+}
@@ -0,0 +1,99 @@
+package module
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// optional, the name other modules depend on, the type name is used if a
+// module does not implement it
+type Named interface {
+	ModuleName() string
+}
+
+// optional, the names of the modules to init before the module and to
+// destroy after it
+type Dependent interface {
+	Dependencies() []string
+}
+
+func moduleName(mi Module) string {
+	if n, ok := mi.(Named); ok {
+		return n.ModuleName()
+	}
+	return reflect.TypeOf(mi).String()
+}
+
+func dependencies(mi Module) []string {
+	if d, ok := mi.(Dependent); ok {
+		return d.Dependencies()
+	}
+	return nil
+}
+
+// sortModules orders the modules so that every module comes after its
+// dependencies, the registration order is kept otherwise
+func sortModules(mods []*module) ([]*module, error) {
+	// name -> index, -1 if the name is shared
+	index := make(map[string]int)
+	for i, m := range mods {
+		if _, ok := index[m.name]; ok {
+			index[m.name] = -1
+		} else {
+			index[m.name] = i
+		}
+	}
+
+	for _, m := range mods {
+		for _, dep := range m.deps {
+			i, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("module %v depends on %v which is not registered", m.name, dep)
+			}
+			if i < 0 {
+				return nil, fmt.Errorf("module %v depends on %v which is registered more than once", m.name, dep)
+			}
+		}
+	}
+
+	// depth first, in registration order
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(mods))
+	sorted := make([]*module, 0, len(mods))
+	var path []string
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		m := mods[i]
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("module dependency cycle: %v -> %v", strings.Join(path, " -> "), m.name)
+		}
+
+		state[i] = visiting
+		path = append(path, m.name)
+		for _, dep := range m.deps {
+			if err := visit(index[dep]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		sorted = append(sorted, m)
+		return nil
+	}
+
+	for i := range mods {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
@@ -0,0 +1,36 @@
+package module
+
+import "testing"
+
+func TestSortModules(t *testing.T) {
+	mod := func(name string, deps ...string) *module {
+		return &module{name: name, deps: deps}
+	}
+
+	tests := []struct {
+		mods []*module
+		want string // the sorted names or the error
+	}{
+		{[]*module{mod("a", "b"), mod("b"), mod("c", "a")}, "b a c"},
+		{[]*module{mod("a", "b"), mod("c")}, "module a depends on b which is not registered"},
+		{[]*module{mod("a", "b"), mod("b"), mod("b")}, "module a depends on b which is registered more than once"},
+		{[]*module{mod("a", "b"), mod("b", "c"), mod("c", "a")}, "module dependency cycle: a -> b -> c -> a"},
+		{[]*module{mod("a"), mod("b", "b")}, "module dependency cycle: b -> b"},
+	}
+	for _, test := range tests {
+		var got string
+		sorted, err := sortModules(test.mods)
+		if err != nil {
+			got = err.Error()
+		}
+		for i, m := range sorted {
+			if i > 0 {
+				got += " "
+			}
+			got += m.name
+		}
+		if got != test.want {
+			t.Errorf("sortModules: %q, want %q", got, test.want)
+		}
+	}
+}
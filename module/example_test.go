@@ -0,0 +1,39 @@
+package module_test
+
+import (
+	"fmt"
+
+	"github.com/rufeng18/tinyleaf/module"
+)
+
+type exampleModule struct {
+	name string
+	deps []string
+}
+
+func (m *exampleModule) ModuleName() string     { return m.name }
+func (m *exampleModule) Dependencies() []string { return m.deps }
+func (m *exampleModule) OnInit()                { fmt.Println("init", m.name) }
+func (m *exampleModule) OnDestroy()             { fmt.Println("destroy", m.name) }
+func (m *exampleModule) OnReload()              {}
+func (m *exampleModule) Run(closeSig chan bool) { <-closeSig }
+
+func Example() {
+	module.Register(&exampleModule{name: "game", deps: []string{"db", "login"}})
+	module.Register(&exampleModule{name: "login", deps: []string{"db"}})
+	module.Register(&exampleModule{name: "gate", deps: []string{"game"}})
+	module.Register(&exampleModule{name: "db"})
+
+	module.Init()
+	module.Destroy()
+
+	// Output:
+	// init db
+	// init login
+	// init game
+	// init gate
+	// destroy gate
+	// destroy game
+	// destroy login
+	// destroy db
+}
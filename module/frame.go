@@ -0,0 +1,143 @@
+package module
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/timer"
+)
+
+// what the loop does when frames are late
+type FramePolicy int
+
+const (
+	// run the missed frames, at most MaxCatchUp at a time, the others are
+	// skipped
+	FrameCatchUp FramePolicy = iota
+	// run one frame only, the missed ones are skipped
+	FrameSkip
+)
+
+type Frame struct {
+	Number uint64        // the skipped frames are counted
+	Delta  time.Duration // since the previous frame, a multiple of LoopInterval
+	Time   time.Time     // the scheduled time
+}
+
+type FrameStats struct {
+	Frames   uint64
+	Skipped  uint64
+	Overruns uint64        // frames longer than LoopInterval
+	Total    time.Duration // total OnUpdate time
+	Max      time.Duration
+	Last     time.Duration
+}
+
+type frameLoop struct {
+	interval   time.Duration
+	next       time.Time
+	t          timer.ClockTimer
+	tick       chan func()
+	frame      Frame
+	mutexStats sync.Mutex
+	stats      FrameStats
+}
+
+// the channel is nil without LoopInterval, the function received is called
+// once the tick is handled, see timer.Hold
+func (s *Skeleton) startLoop() <-chan func() {
+	if s.LoopInterval <= 0 {
+		return nil
+	}
+
+	l := &s.loop
+	l.interval = time.Duration(s.LoopInterval) * time.Millisecond
+	l.next = s.Clock.Now().Add(l.interval)
+	l.tick = make(chan func(), 1)
+	s.schedule(l.interval)
+	return l.tick
+}
+
+func (s *Skeleton) schedule(d time.Duration) {
+	tick := s.loop.tick
+	clock := s.Clock
+	s.loop.t = clock.AfterFunc(d, func() {
+		tick <- timer.Hold(clock)
+	})
+}
+
+func (s *Skeleton) stopLoop() {
+	if s.loop.t != nil {
+		s.loop.t.Stop()
+	}
+	// a tick fired meanwhile is released
+	select {
+	case done := <-s.loop.tick:
+		done()
+	default:
+	}
+}
+
+func (s *Skeleton) onTick() {
+	l := &s.loop
+	due := int(s.Clock.Now().Sub(l.next)/l.interval) + 1
+	if due < 1 {
+		due = 1
+	}
+	run := due
+	if s.FramePolicy == FrameSkip {
+		run = 1
+	} else if run > s.MaxCatchUp {
+		run = s.MaxCatchUp
+	}
+	skipped := due - run
+
+	for i := 0; i < run; i++ {
+		n := 1
+		if i == 0 {
+			n += skipped
+		}
+		l.frame.Number += uint64(n)
+		l.frame.Delta = time.Duration(n) * l.interval
+		l.frame.Time = l.next.Add(time.Duration(n-1) * l.interval)
+		l.next = l.frame.Time.Add(l.interval)
+
+		start := time.Now()
+		s.client.Flush()
+		if s.IProcess != nil {
+			s.IProcess.OnUpdate()
+		}
+		s.recordFrame(time.Since(start), n-1)
+	}
+
+	s.schedule(l.next.Sub(s.Clock.Now()))
+}
+
+func (s *Skeleton) recordFrame(d time.Duration, skipped int) {
+	l := &s.loop
+	l.mutexStats.Lock()
+	defer l.mutexStats.Unlock()
+
+	l.stats.Frames++
+	l.stats.Skipped += uint64(skipped)
+	if d > l.interval {
+		l.stats.Overruns++
+	}
+	l.stats.Total += d
+	if d > l.stats.Max {
+		l.stats.Max = d
+	}
+	l.stats.Last = d
+}
+
+// Frame returns the frame being updated, it is meant for OnUpdate
+func (s *Skeleton) Frame() Frame {
+	return s.loop.frame
+}
+
+// goroutine safe
+func (s *Skeleton) FrameStats() FrameStats {
+	s.loop.mutexStats.Lock()
+	defer s.loop.mutexStats.Unlock()
+	return s.loop.stats
+}
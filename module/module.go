@@ -1,7 +1,10 @@
 package module
 
 import (
+	"context"
+	"fmt"
 	"runtime"
+	"strings"
 	"sync"
 
 	"github.com/rufeng18/tinyleaf/conf"
@@ -17,50 +20,100 @@ type Module interface {
 
 type module struct {
 	mi       Module
+	name     string
+	deps     []string
 	closeSig chan bool
 	wg       sync.WaitGroup
+
+	supervision Supervision
+	restarts    uint32
+	state       int32
+	startTime   int64
 }
 
-var mods []*module
+var (
+	mutexMods sync.RWMutex
+	mods      []*module
+)
 
 func Register(mi Module) {
 	m := new(module)
 	m.mi = mi
+	m.name = moduleName(mi)
+	m.deps = dependencies(mi)
+	m.supervision = supervision(mi)
 	m.closeSig = make(chan bool, 1)
 
+	mutexMods.Lock()
 	mods = append(mods, m)
+	mutexMods.Unlock()
 }
 
+// the modules are initialized after their dependencies, a missing
+// dependency or a cycle is fatal
 func Init() {
+	sorted, err := sortModules(mods)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	mutexMods.Lock()
+	mods = sorted
+	mutexMods.Unlock()
+
+	loadConfig()
+
 	for i := 0; i < len(mods); i++ {
+		mods[i].setState(StateInitializing)
 		mods[i].mi.OnInit()
 	}
 
 	for i := 0; i < len(mods); i++ {
 		m := mods[i]
 		m.wg.Add(1)
+		m.setState(StateRunning)
 		go run(m)
 	}
 }
 
-func Destroy() {
+// Destroy stops the modules in reverse init order, each within its shutdown
+// timeout and all within conf.ShutdownTimeout. A module which does not stop
+// in time is left running without OnDestroy and its pending work is logged,
+// the error lists such modules and the process should exit.
+func Destroy() error {
+	ctx := context.Background()
+	if conf.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.ShutdownTimeout)
+		defer cancel()
+	}
+
+	var abandoned []string
 	for i := len(mods) - 1; i >= 0; i-- {
 		m := mods[i]
+		if m.getState() != StateDead {
+			m.setState(StateStopping)
+		}
 		m.closeSig <- true
-		m.wg.Wait()
+		if !m.wait(ctx) {
+			log.Error("module %v not stopped in time, pending: %v", m.name, pendingReport(m))
+			abandoned = append(abandoned, m.name)
+			continue
+		}
+
 		destroy(m)
+		if m.getState() != StateDead {
+			m.setState(StateStopped)
+		}
 	}
-}
 
-func Reload() {
-	for i := len(mods) - 1; i >= 0; i-- {
-		mods[i].mi.OnReload()
-	}
-}
+	mutexMods.Lock()
+	mods = nil
+	mutexMods.Unlock()
 
-func run(m *module) {
-	m.mi.Run(m.closeSig)
-	m.wg.Done()
+	if len(abandoned) > 0 {
+		return fmt.Errorf("modules not stopped: %v", strings.Join(abandoned, ", "))
+	}
+	return nil
 }
 
 func destroy(m *module) {
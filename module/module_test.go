@@ -0,0 +1,338 @@
+package module_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/module"
+)
+
+type crashModule struct {
+	name     string
+	strategy module.Strategy
+	crashes  int
+	runs     chan int
+}
+
+func (m *crashModule) ModuleName() string { return m.name }
+func (m *crashModule) OnInit()            {}
+func (m *crashModule) OnDestroy()         {}
+func (m *crashModule) OnReload()          {}
+
+func (m *crashModule) Supervision() module.Supervision {
+	return module.Supervision{Strategy: m.strategy, MinBackoff: time.Millisecond}
+}
+
+func (m *crashModule) Run(closeSig chan bool) {
+	m.runs <- 1
+	if m.crashes > 0 {
+		m.crashes--
+		panic("crash")
+	}
+	<-closeSig
+}
+
+func TestSupervisor(t *testing.T) {
+	restart := &crashModule{name: "restart", strategy: module.StrategyRestart, crashes: 2, runs: make(chan int, 10)}
+	stop := &crashModule{name: "stop", strategy: module.StrategyStop, crashes: 1, runs: make(chan int, 10)}
+	escalate := &crashModule{name: "escalate", strategy: module.StrategyEscalate, crashes: 1, runs: make(chan int, 10)}
+	module.Register(restart)
+	module.Register(stop)
+	module.Register(escalate)
+	module.Init()
+
+	select {
+	case name := <-module.Escalated():
+		if name != "escalate" {
+			t.Fatalf("Escalated: %v", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Escalated: timeout")
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-restart.runs:
+		case <-time.After(time.Second):
+			t.Fatalf("restart: %v runs", i)
+		}
+	}
+
+	module.Destroy()
+	if len(stop.runs) != 1 || len(escalate.runs) != 1 || len(restart.runs) != 0 {
+		t.Fatalf("runs: stop %v, escalate %v, restart %v", len(stop.runs), len(escalate.runs), len(restart.runs))
+	}
+}
+
+// Run crashes once it gets closeSig
+type stopCrashModule struct {
+	crashModule
+}
+
+func (m *stopCrashModule) Run(closeSig chan bool) {
+	m.runs <- 1
+	<-closeSig
+	panic("crash")
+}
+
+func TestSupervisorDestroy(t *testing.T) {
+	m := &stopCrashModule{crashModule{name: "stopcrash", strategy: module.StrategyRestart, runs: make(chan int, 10)}}
+	module.Register(m)
+	module.Init()
+	<-m.runs
+
+	err := module.Destroy()
+	if err != nil || len(m.runs) != 0 {
+		t.Fatalf("Destroy: %v, %v restarts", err, len(m.runs))
+	}
+}
+
+type healthModule struct {
+	crashModule
+	health error
+}
+
+func (m *healthModule) HealthCheck() error { return m.health }
+
+func TestModules(t *testing.T) {
+	healthy := &healthModule{crashModule: crashModule{name: "healthy", runs: make(chan int, 10)}}
+	sick := &healthModule{crashModule: crashModule{name: "sick", runs: make(chan int, 10)}, health: errors.New("db down")}
+	dead := &crashModule{name: "dead", strategy: module.StrategyStop, crashes: 1, runs: make(chan int, 10)}
+	module.Register(healthy)
+	module.Register(sick)
+	module.Register(dead)
+
+	if infos := module.Modules(); len(infos) != 3 || infos[0].State != module.StateRegistered {
+		t.Fatalf("Modules: %v", infos)
+	}
+
+	module.Init()
+	<-healthy.runs
+	<-sick.runs
+	<-dead.runs
+
+	// dead crashes after its run
+	var infos []module.Info
+	deadline := time.Now().Add(time.Second)
+	for {
+		infos = module.Modules()
+		if infos[2].State == module.StateDead || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if infos[0].Name != "healthy" || infos[0].State != module.StateRunning || infos[0].Health != nil {
+		t.Fatalf("healthy: %+v", infos[0])
+	}
+	if infos[1].State != module.StateRunning || infos[1].Health == nil || infos[1].Health.Error() != "db down" {
+		t.Fatalf("sick: %+v", infos[1])
+	}
+	if infos[2].State != module.StateDead {
+		t.Fatalf("dead: %+v", infos[2])
+	}
+
+	module.Destroy()
+	if infos := module.Modules(); len(infos) != 0 {
+		t.Fatalf("Modules after Destroy: %v", infos)
+	}
+}
+
+type slowHealthModule struct {
+	crashModule
+	checking chan bool
+	release  chan bool
+}
+
+func (m *slowHealthModule) HealthCheck() error {
+	m.checking <- true
+	<-m.release
+	return nil
+}
+
+func TestModulesSlowHealth(t *testing.T) {
+	slow := &slowHealthModule{
+		crashModule: crashModule{name: "slow", runs: make(chan int, 10)},
+		checking:    make(chan bool, 1),
+		release:     make(chan bool),
+	}
+	module.Register(slow)
+	module.Init()
+	<-slow.runs
+
+	done := make(chan []module.Info)
+	go func() {
+		done <- module.Modules()
+	}()
+	<-slow.checking
+
+	// the health checks run without the lock of the modules
+	registered := make(chan bool)
+	go func() {
+		module.Register(&crashModule{name: "late", runs: make(chan int, 10)})
+		registered <- true
+	}()
+	select {
+	case <-registered:
+	case <-time.After(time.Second):
+		t.Fatal("Register blocked by HealthCheck")
+	}
+
+	close(slow.release)
+	if infos := <-done; len(infos) != 1 || infos[0].Health != nil {
+		t.Fatalf("Modules: %+v", infos)
+	}
+	module.Destroy()
+}
+
+type hangModule struct {
+	crashModule
+	destroyed bool
+}
+
+func (m *hangModule) Run(closeSig chan bool) { select {} }
+func (m *hangModule) OnDestroy()             { m.destroyed = true }
+
+func (m *hangModule) ShutdownTimeout() time.Duration { return 10 * time.Millisecond }
+
+func (m *hangModule) QueueLens() map[string]int {
+	return map[string]int{"pending go": 2, "chanrpc": 0}
+}
+
+func TestDestroyTimeout(t *testing.T) {
+	hang := &hangModule{crashModule: crashModule{name: "hang"}}
+	ok := &crashModule{name: "ok", runs: make(chan int, 10)}
+	module.Register(ok)
+	module.Register(hang)
+	module.Init()
+
+	start := time.Now()
+	err := module.Destroy()
+	if err == nil || err.Error() != "modules not stopped: hang" {
+		t.Fatalf("Destroy: %v", err)
+	}
+	if hang.destroyed {
+		t.Fatal("OnDestroy called on a running module")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Destroy took %v", d)
+	}
+}
+
+type reloadModule struct {
+	crashModule
+	section string
+}
+
+func (m *reloadModule) OnConfigReload(section json.RawMessage) error {
+	if string(section) == `"bad"` {
+		return errors.New("bad config")
+	}
+	m.section = string(section)
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	cfg := map[string]json.RawMessage{"a": json.RawMessage(`1`), "b": json.RawMessage(`2`)}
+	module.SetConfigSource(func() (map[string]json.RawMessage, error) {
+		return cfg, nil
+	})
+	defer module.SetConfigSource(nil)
+
+	a := &reloadModule{crashModule: crashModule{name: "a", runs: make(chan int, 10)}}
+	b := &reloadModule{crashModule: crashModule{name: "b", runs: make(chan int, 10)}}
+	module.Register(a)
+	module.Register(b)
+	module.Init()
+	defer module.Destroy()
+
+	cfg = map[string]json.RawMessage{"a": json.RawMessage(`1`), "b": json.RawMessage(`3`)}
+	if err := module.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if a.section != "" || b.section != "3" {
+		t.Fatalf("Reload: a %q, b %q", a.section, b.section)
+	}
+
+	cfg = map[string]json.RawMessage{"a": json.RawMessage(`4`), "b": json.RawMessage(`"bad"`)}
+	if err := module.Reload(); err == nil {
+		t.Fatal("Reload: rejection expected")
+	}
+	if a.section != "1" || b.section != "3" || string(module.ConfigSection("a")) != "1" {
+		t.Fatalf("rollback: a %q, b %q", a.section, b.section)
+	}
+
+	// a check rejects the config before the modules see it
+	cfg = map[string]json.RawMessage{"a": json.RawMessage(`5`), "b": json.RawMessage(`6`)}
+	err := module.ReloadChecked(func(cfg map[string]json.RawMessage) error {
+		return errors.New("bad check")
+	})
+	if err == nil || a.section != "1" || b.section != "3" || string(module.ConfigSection("b")) != "3" {
+		t.Fatalf("ReloadChecked: %v, a %q, b %q", err, a.section, b.section)
+	}
+}
+
+type skeletonModule struct {
+	*module.Skeleton
+	section string
+}
+
+func (m *skeletonModule) ModuleName() string { return "c" }
+func (m *skeletonModule) OnInit()            {}
+func (m *skeletonModule) OnDestroy()         {}
+func (m *skeletonModule) OnReload()          {}
+
+func (m *skeletonModule) OnConfigReload(section json.RawMessage) error {
+	m.section = string(section)
+	return nil
+}
+
+func TestReloadSkeleton(t *testing.T) {
+	cfg := map[string]json.RawMessage{"c": json.RawMessage(`1`)}
+	module.SetConfigSource(func() (map[string]json.RawMessage, error) {
+		return cfg, nil
+	})
+	defer module.SetConfigSource(nil)
+
+	server := chanrpc.NewServer(10)
+	m := &skeletonModule{Skeleton: &module.Skeleton{ChanRPCServer: server}}
+	m.Skeleton.Init()
+	m.RegisterChanRPC("section", func([]interface{}) interface{} {
+		return m.section
+	})
+	module.Register(m)
+	module.Init()
+	defer module.Destroy()
+
+	// the section is set on the goroutine of the Skeleton
+	cfg = map[string]json.RawMessage{"c": json.RawMessage(`2`)}
+	if err := module.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if section, err := server.Call1("section"); err != nil || section != "2" {
+		t.Fatalf("section: %v, %v", section, err)
+	}
+
+	// a wedged Skeleton fails the reload in time and never applies it
+	timeout := conf.ModuleReloadTimeout
+	conf.ModuleReloadTimeout = 50 * time.Millisecond
+	defer func() { conf.ModuleReloadTimeout = timeout }()
+	release := make(chan bool)
+	m.RegisterChanRPC("wedge", func([]interface{}) {
+		<-release
+	})
+	server.Go("wedge")
+
+	cfg = map[string]json.RawMessage{"c": json.RawMessage(`3`)}
+	err := module.Reload()
+	release <- true
+	if err == nil || err.Error() != "module c rejects the config: context deadline exceeded" {
+		t.Fatalf("Reload: %v", err)
+	}
+	if section, err := server.Call1("section"); err != nil || section != "2" {
+		t.Fatalf("section: %v, %v", section, err)
+	}
+}
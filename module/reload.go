@@ -0,0 +1,172 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+// ConfigSource loads the config, a JSON object with a section per module
+// name such as {"game": {"MaxPlayers": 1000}, "login": {...}}. The section
+// "LogLevel" is reserved, leaf sets conf.LogLevel with it.
+type ConfigSource func() (map[string]json.RawMessage, error)
+
+// optional, the module gets its section when it changes. An error rejects
+// the reload, then the modules already reloaded get their old section back.
+// It is called on the goroutine of a running Executor, such as a module
+// with *Skeleton, within conf.ModuleReloadTimeout, or on the goroutine
+// calling Reload otherwise, then the module must guard its state itself.
+type Reloadable interface {
+	OnConfigReload(section json.RawMessage) error
+}
+
+// optional, Exec runs f on the goroutine of the module and returns its
+// error, or ctx.Err() if ctx is done first, then f should not run
+type Executor interface {
+	Exec(ctx context.Context, f func() error) error
+}
+
+var (
+	configSource ConfigSource
+	mutexConfig  sync.RWMutex
+	config       map[string]json.RawMessage
+)
+
+// you must call the function before calling module.Init
+// goroutine not safe
+func SetConfigSource(src ConfigSource) {
+	configSource = src
+}
+
+// FileSource reads the config from a JSON file
+func FileSource(path string) ConfigSource {
+	return func() (map[string]json.RawMessage, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var cfg map[string]json.RawMessage
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config %v: %v", path, err)
+		}
+		return cfg, nil
+	}
+}
+
+// ConfigSection returns the section of the module in the config loaded
+// last, nil if there is none
+// goroutine safe
+func ConfigSection(name string) json.RawMessage {
+	mutexConfig.RLock()
+	defer mutexConfig.RUnlock()
+	return config[name]
+}
+
+func loadConfig() {
+	if configSource == nil {
+		return
+	}
+
+	cfg, err := configSource()
+	if err != nil {
+		log.Fatal("load config error: %v", err)
+	}
+	mutexConfig.Lock()
+	config = cfg
+	mutexConfig.Unlock()
+}
+
+// Reload reloads the config source and calls OnConfigReload of the modules
+// whose section changed, in init order, or OnReload of the modules which
+// are not Reloadable. Nothing changes if the source fails or a module
+// rejects its section.
+func Reload() error {
+	return ReloadChecked(nil)
+}
+
+// ReloadChecked is Reload with check called on the config first, an error
+// rejects it before any module is reloaded. It is meant for the sections
+// which are not modules, such as "LogLevel".
+func ReloadChecked(check func(cfg map[string]json.RawMessage) error) error {
+	mutexMods.RLock()
+	mods := append([]*module(nil), mods...)
+	mutexMods.RUnlock()
+
+	if configSource == nil {
+		for i := len(mods) - 1; i >= 0; i-- {
+			mods[i].mi.OnReload()
+		}
+		return nil
+	}
+
+	cfg, err := configSource()
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		err := check(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	var reloaded []*module
+	for _, m := range mods {
+		r, ok := m.mi.(Reloadable)
+		if !ok || bytes.Equal(config[m.name], cfg[m.name]) {
+			continue
+		}
+
+		err := configReload(m, r, cfg[m.name])
+		if err != nil {
+			rollback(reloaded)
+			return fmt.Errorf("module %v rejects the config: %v", m.name, err)
+		}
+		reloaded = append(reloaded, m)
+		log.Release("module %v config reloaded", m.name)
+	}
+	mutexConfig.Lock()
+	config = cfg
+	mutexConfig.Unlock()
+
+	for i := len(mods) - 1; i >= 0; i-- {
+		if _, ok := mods[i].mi.(Reloadable); !ok {
+			mods[i].mi.OnReload()
+		}
+	}
+	return nil
+}
+
+func rollback(reloaded []*module) {
+	for i := len(reloaded) - 1; i >= 0; i-- {
+		m := reloaded[i]
+		err := configReload(m, m.mi.(Reloadable), config[m.name])
+		if err != nil {
+			log.Error("module %v rollback error: %v", m.name, err)
+		}
+	}
+}
+
+// a wedged module fails after conf.ModuleReloadTimeout
+func configReload(m *module, r Reloadable, section json.RawMessage) error {
+	if e, ok := m.mi.(Executor); ok && State(atomic.LoadInt32(&m.state)) == StateRunning {
+		ctx := context.Background()
+		if conf.ModuleReloadTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, conf.ModuleReloadTimeout)
+			defer cancel()
+		}
+		return e.Exec(ctx, func() error {
+			return r.OnConfigReload(section)
+		})
+	}
+	return r.OnConfigReload(section)
+}
@@ -0,0 +1,68 @@
+package module
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/conf"
+)
+
+// optional, the shutdown timeout of the module instead of
+// conf.ModuleShutdownTimeout, 0 for no limit
+type ShutdownLimited interface {
+	ShutdownTimeout() time.Duration
+}
+
+func shutdownTimeout(mi Module) time.Duration {
+	if sl, ok := mi.(ShutdownLimited); ok {
+		return sl.ShutdownTimeout()
+	}
+	return conf.ModuleShutdownTimeout
+}
+
+// wait returns false if Run does not return before the shutdown timeout of
+// the module or ctx is done
+func (m *module) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if d := shutdownTimeout(m.mi); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func pendingReport(m *module) string {
+	qr, ok := m.mi.(QueueReporter)
+	if !ok {
+		return "unknown"
+	}
+
+	var pending []string
+	for name, l := range qr.QueueLens() {
+		if l > 0 {
+			pending = append(pending, fmt.Sprintf("%v %v", name, l))
+		}
+	}
+	if len(pending) == 0 {
+		return "none"
+	}
+	sort.Strings(pending)
+	return strings.Join(pending, ", ")
+}
@@ -2,23 +2,32 @@ package module
 
 import (
 	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/cluster"
 	"github.com/rufeng18/tinyleaf/console"
 	"github.com/rufeng18/tinyleaf/go"
 	//"github.com/rufeng18/tinyleaf/log"
+	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/rufeng18/tinyleaf/timer"
 )
 
+// how often the queued asynchronous calls are retried
+const flushInterval = 10 * time.Millisecond
+
 // interface for logic
 type IProcess interface {
 	OnUpdate()
 }
 
 type Skeleton struct {
+	Name               string
 	GoLen              int
 	TimerDispatcherLen int
+	TimerWheelTick     time.Duration // timers on a timing wheel instead of TimerDispatcherLen
 	AsynCallLen        int
+	AsynCallPolicy     chanrpc.Backpressure
 	ChanRPCServer      *chanrpc.Server
 	g                  *g.Go
 	dispatcher         *timer.Dispatcher
@@ -26,7 +35,17 @@ type Skeleton struct {
 	server             *chanrpc.Server
 	commandServer      *chanrpc.Server
 	IProcess
-	LoopInterval int // 毫秒
+	Clock        timer.Clock // timer.SystemClock by default
+	LoopInterval int         // 毫秒, 0 for no OnUpdate
+	FramePolicy  FramePolicy
+	MaxCatchUp   int // frames per tick for FrameCatchUp, 5 by default
+	loop         frameLoop
+	wheelTick    chan func()
+	wheelTimer   timer.ClockTimer
+
+	// for QueueLens
+	pendingGo       int32
+	pendingAsynCall int32
 }
 
 func (s *Skeleton) Init() {
@@ -39,75 +58,204 @@ func (s *Skeleton) Init() {
 	if s.AsynCallLen <= 0 {
 		s.AsynCallLen = 0
 	}
+	if s.MaxCatchUp <= 0 {
+		s.MaxCatchUp = 5
+	}
+
+	if s.Clock == nil {
+		s.Clock = timer.SystemClock
+	}
 
 	s.g = g.New(s.GoLen)
-	s.dispatcher = timer.NewDispatcher(s.TimerDispatcherLen)
+	if s.TimerWheelTick > 0 {
+		s.dispatcher = timer.NewWheelDispatcher(s.TimerWheelTick)
+	} else {
+		s.dispatcher = timer.NewDispatcher(s.TimerDispatcherLen)
+	}
+	s.dispatcher.SetClock(s.Clock)
+	s.dispatcher.SetHold(true)
 	s.client = chanrpc.NewClient(s.AsynCallLen)
+	s.client.SetBackpressure(s.AsynCallPolicy)
 	s.server = s.ChanRPCServer
 
 	if s.server == nil {
 		s.server = chanrpc.NewServer(0)
 	}
+	if s.server.Name == "" {
+		s.server.Name = s.Name
+	}
+	if s.server.Name != "" {
+		chanrpc.ListServer(s.server)
+	}
 	s.commandServer = chanrpc.NewServer(0)
+	s.commandServer.Register(execID{}, func(args []interface{}) interface{} {
+		return args[0].(func() error)()
+	})
 	s.SetProcessor(nil)
 }
 
 func (s *Skeleton) Run(closeSig chan bool) {
+	tick := s.startLoop()
+	defer s.stopLoop()
+	wheelTick := s.startWheel()
+	defer s.stopWheel()
+
+	for {
+		s.storePending()
 
-	timeout := make(chan bool, 1)
-	go func() {
-		for {
+		// the higher lanes first, a bounded number of calls at a time
+		s.server.Drain()
 
-			time.Sleep(time.Millisecond * time.Duration(s.LoopInterval)) // sleep Millisecond second
-			timeout <- true
+		// the queued asynchronous calls wait for a server to free capacity,
+		// which may not wake the loop
+		s.client.Flush()
+		var retry <-chan time.Time
+		if s.client.Stats().QueueLen > 0 {
+			retry = time.After(flushInterval)
 		}
-	}()
 
-	for {
 		select {
 		case <-closeSig:
 			s.commandServer.Close()
 			s.server.Close()
-			for !s.g.Idle() || !s.client.Idle() {
-				s.g.Close()
-				s.client.Close()
-			}
+			s.close()
 			return
 		case ri := <-s.client.ChanAsynRet:
 			s.client.Cb(ri)
 		case ci := <-s.server.ChanCall:
 			s.server.Exec(ci)
+		case ci := <-s.server.Lane(chanrpc.PriorityHigh):
+			s.server.Exec(ci)
+		case ci := <-s.server.Lane(chanrpc.PriorityUrgent):
+			s.server.Exec(ci)
 		case ci := <-s.commandServer.ChanCall:
 			s.commandServer.Exec(ci)
 		case cb := <-s.g.ChanCb:
 			s.g.Cb(cb)
 		case t := <-s.dispatcher.ChanTimer:
 			t.Cb()
-			t.Stop()
-		case <-timeout:
-			if s.IProcess != nil {
-				s.IProcess.OnUpdate()
-			}
+		case done := <-tick:
+			s.onTick()
+			done()
+		case done := <-wheelTick:
+			s.dispatcher.Advance()
+			s.scheduleWheel()
+			done()
+		case <-retry:
 		}
 	}
 }
 
+// close executes the pending callbacks one by one, so that QueueLens reports
+// what is still pending if it takes too long
+func (s *Skeleton) close() {
+	for {
+		s.storePending()
+		if s.client.Pending() == 0 {
+			// the queued calls are rejected at once
+			s.client.Close()
+		}
+		if s.g.Idle() && s.client.Idle() {
+			return
+		}
+
+		select {
+		case cb := <-s.g.ChanCb:
+			s.g.Cb(cb)
+		case ri := <-s.client.ChanAsynRet:
+			s.client.Cb(ri)
+		}
+	}
+}
+
+func (s *Skeleton) storePending() {
+	atomic.StoreInt32(&s.pendingGo, int32(s.g.Pending()))
+	atomic.StoreInt32(&s.pendingAsynCall, int32(s.client.Pending()))
+}
+
 func (s *Skeleton) AfterFunc(d time.Duration, cb func()) *timer.Timer {
-	if s.TimerDispatcherLen == 0 {
+	if s.TimerDispatcherLen == 0 && s.TimerWheelTick == 0 {
 		panic("invalid TimerDispatcherLen")
 	}
 
 	return s.dispatcher.AfterFunc(d, cb)
 }
 
+func (s *Skeleton) Every(interval time.Duration, cb func()) *timer.Timer {
+	if s.TimerDispatcherLen == 0 && s.TimerWheelTick == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return s.dispatcher.Every(interval, cb)
+}
+
 func (s *Skeleton) CronFunc(cronExpr *timer.CronExpr, cb func()) *timer.Cron {
-	if s.TimerDispatcherLen == 0 {
+	if s.TimerDispatcherLen == 0 && s.TimerWheelTick == 0 {
 		panic("invalid TimerDispatcherLen")
 	}
 
 	return s.dispatcher.CronFunc(cronExpr, cb)
 }
 
+// the channel is nil without TimerWheelTick, like the one of startLoop
+func (s *Skeleton) startWheel() <-chan func() {
+	if s.TimerWheelTick <= 0 {
+		return nil
+	}
+
+	s.wheelTick = make(chan func(), 1)
+	s.scheduleWheel()
+	return s.wheelTick
+}
+
+func (s *Skeleton) scheduleWheel() {
+	tick := s.wheelTick
+	clock := s.Clock
+	s.wheelTimer = clock.AfterFunc(s.TimerWheelTick, func() {
+		tick <- timer.Hold(clock)
+	})
+}
+
+func (s *Skeleton) stopWheel() {
+	if s.wheelTimer != nil {
+		s.wheelTimer.Stop()
+	}
+	select {
+	case done := <-s.wheelTick:
+		done()
+	default:
+	}
+}
+
+type execID struct{}
+
+// Exec runs f on the goroutine of the Skeleton and returns its error, it
+// implements Executor. f is skipped if ctx is done before it starts.
+// goroutine safe, but not on the goroutine of the Skeleton
+func (s *Skeleton) Exec(ctx context.Context, f func() error) error {
+	// 1 when f starts, 2 when it is abandoned
+	var state int32
+	ret, err := s.commandServer.Call1Context(ctx, execID{}, func() error {
+		if !atomic.CompareAndSwapInt32(&state, 0, 1) {
+			return ctx.Err()
+		}
+		return f()
+	})
+	if err != nil {
+		atomic.CompareAndSwapInt32(&state, 0, 2)
+		return err
+	}
+	if ret == nil {
+		return nil
+	}
+	return ret.(error)
+}
+
+// Now returns the time of the Clock
+func (s *Skeleton) Now() time.Time {
+	return s.Clock.Now()
+}
+
 func (s *Skeleton) Go(f func(), cb func()) {
 	if s.GoLen == 0 {
 		panic("invalid GoLen")
@@ -140,6 +288,53 @@ func (s *Skeleton) AsynCall(server *chanrpc.Server, id interface{}, args ...inte
 	s.client.AsynCall(id, args...)
 }
 
+func (s *Skeleton) AsynGather(servers []*chanrpc.Server, opts chanrpc.GatherOptions, id interface{}, args []interface{}, cb func(results []chanrpc.GatherResult)) {
+	if s.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+
+	s.client.AsynGather(servers, opts, id, args, cb)
+}
+
+// QueueLens implements QueueReporter
+// goroutine safe
+func (s *Skeleton) QueueLens() map[string]int {
+	if s == nil || s.server == nil {
+		return nil
+	}
+
+	return map[string]int{
+		"chanrpc": s.server.QueueLen(),
+		"command": s.commandServer.QueueLen(),
+		"asynret": len(s.client.ChanAsynRet),
+		"go":      len(s.g.ChanCb),
+		"timer":   len(s.dispatcher.ChanTimer),
+
+		"pending go":       int(atomic.LoadInt32(&s.pendingGo)),
+		"pending asyncall": int(atomic.LoadInt32(&s.pendingAsynCall)),
+	}
+}
+
+func (s *Skeleton) AsynCallStats() chanrpc.AsynStats {
+	return s.client.Stats()
+}
+
+func (s *Skeleton) ClusterAsynCall(node string, server string, id interface{}, args ...interface{}) {
+	if s.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+
+	cluster.AsynCall(s.client, node, server, id, args...)
+}
+
+func (s *Skeleton) ClusterAsynGather(nodes []string, opts chanrpc.GatherOptions, server string, id interface{}, args []interface{}, cb func(results []chanrpc.GatherResult)) {
+	if s.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+
+	cluster.AsynGather(s.client, nodes, opts, server, id, args, cb)
+}
+
 func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 	if s.ChanRPCServer == nil {
 		panic("invalid ChanRPCServer")
@@ -0,0 +1,204 @@
+package module_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/chanrpc"
+	"github.com/rufeng18/tinyleaf/module"
+	"github.com/rufeng18/tinyleaf/timer"
+)
+
+type frameProcess struct {
+	s      *module.Skeleton
+	frames []module.Frame
+	done   chan bool
+}
+
+func (p *frameProcess) OnUpdate() {
+	f := p.s.Frame()
+	p.frames = append(p.frames, f)
+	if f.Number == 2 {
+		time.Sleep(35 * time.Millisecond)
+	}
+	if len(p.frames) == 5 {
+		p.done <- true
+	}
+}
+
+func testFrames(t *testing.T, policy module.FramePolicy) []module.Frame {
+	s := &module.Skeleton{LoopInterval: 10, FramePolicy: policy}
+	s.Init()
+	p := &frameProcess{s: s, done: make(chan bool, 1)}
+	s.SetProcessor(p)
+
+	closeSig := make(chan bool, 1)
+	exit := make(chan bool)
+	go func() {
+		s.Run(closeSig)
+		exit <- true
+	}()
+	// a catch-up tick may run more frames before closeSig
+	<-p.done
+	closeSig <- true
+	select {
+	case <-exit:
+	case <-time.After(time.Second):
+		t.Fatal("Run not returned")
+	}
+
+	var last uint64
+	for _, f := range p.frames {
+		if f.Number <= last || f.Delta != time.Duration(f.Number-last)*10*time.Millisecond {
+			t.Fatalf("frames: %+v", p.frames)
+		}
+		last = f.Number
+	}
+	if st := s.FrameStats(); st.Frames < 5 || st.Overruns == 0 || st.Max < 35*time.Millisecond {
+		t.Fatalf("FrameStats: %+v", st)
+	}
+	return p.frames
+}
+
+func TestFrameCatchUp(t *testing.T) {
+	frames := testFrames(t, module.FrameCatchUp)
+	// frame 2 overruns, 3 and 4 are late but run
+	if frames[2].Number != 3 || frames[3].Number != 4 {
+		t.Fatalf("frames: %+v", frames)
+	}
+}
+
+func TestFrameSkip(t *testing.T) {
+	frames := testFrames(t, module.FrameSkip)
+	if frames[2].Number <= 3 {
+		t.Fatalf("frames: %+v", frames)
+	}
+}
+
+func TestSkeletonFakeClock(t *testing.T) {
+	clock := timer.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	server := chanrpc.NewServer(10)
+	s := &module.Skeleton{TimerDispatcherLen: 10, LoopInterval: 100, Clock: clock, ChanRPCServer: server}
+	s.Init()
+	p := &frameProcess{s: s, done: make(chan bool, 1)}
+	s.SetProcessor(p)
+
+	fired := make(chan time.Time, 1)
+	s.AfterFunc(30*time.Second, func() {
+		fired <- s.Now()
+	})
+	s.RegisterChanRPC("ping", func([]interface{}) {})
+
+	closeSig := make(chan bool, 1)
+	exit := make(chan bool)
+	go func() {
+		s.Run(closeSig)
+		exit <- true
+	}()
+
+	// the loop is started
+	server.Call0("ping")
+	clock.Advance(30 * time.Second)
+	select {
+	case now := <-fired:
+		if now != time.Date(2000, 1, 1, 0, 0, 30, 0, time.UTC) {
+			t.Fatalf("fired at %v", now)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer not fired")
+	}
+
+	closeSig <- true
+	<-exit
+
+	// Advance waits for each tick, every frame runs on time
+	if len(p.frames) != 300 {
+		t.Fatalf("frames: %+v", p.frames)
+	}
+	for i, f := range p.frames {
+		if f.Number != uint64(i+1) || f.Delta != 100*time.Millisecond ||
+			f.Time != time.Date(2000, 1, 1, 0, 0, 0, (i+1)*100*int(time.Millisecond), time.UTC) {
+			t.Fatalf("frame %v: %+v", i, f)
+		}
+	}
+}
+
+func TestSkeletonTimerWheel(t *testing.T) {
+	clock := timer.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	server := chanrpc.NewServer(10)
+	s := &module.Skeleton{TimerWheelTick: 10 * time.Millisecond, Clock: clock, ChanRPCServer: server}
+	s.Init()
+
+	fired := make(chan time.Time, 1)
+	s.AfterFunc(time.Second, func() {
+		fired <- s.Now()
+	})
+	s.RegisterChanRPC("ping", func([]interface{}) {})
+
+	closeSig := make(chan bool, 1)
+	exit := make(chan bool)
+	go func() {
+		s.Run(closeSig)
+		exit <- true
+	}()
+	server.Call0("ping")
+
+	// Advance waits for each turn of the wheel
+	clock.Advance(time.Second)
+	select {
+	case now := <-fired:
+		if now != time.Date(2000, 1, 1, 0, 0, 1, 0, time.UTC) {
+			t.Fatalf("fired at %v", now)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer not fired")
+	}
+
+	closeSig <- true
+	<-exit
+}
+
+func TestSkeletonQueueRetry(t *testing.T) {
+	target := chanrpc.NewServer(1)
+	target.Register("f", func([]interface{}) {})
+
+	server := chanrpc.NewServer(10)
+	s := &module.Skeleton{
+		AsynCallLen:    10,
+		AsynCallPolicy: chanrpc.Backpressure{Policy: chanrpc.Queue, QueueLen: 10},
+		ChanRPCServer:  server,
+	}
+	s.Init()
+	done := make(chan error, 1)
+	s.RegisterChanRPC("call", func([]interface{}) {
+		s.AsynCall(target, "f", func(err error) {
+			done <- err
+		})
+	})
+
+	closeSig := make(chan bool, 1)
+	exit := make(chan bool)
+	go func() {
+		s.Run(closeSig)
+		exit <- true
+	}()
+	defer func() {
+		closeSig <- true
+		<-exit
+	}()
+
+	// the channel of target is full, the call is queued with nothing pending
+	target.Go("f")
+	server.Call0("call")
+	target.Exec(<-target.ChanCall)
+
+	select {
+	case ci := <-target.ChanCall:
+		target.Exec(ci)
+	case <-time.After(time.Second):
+		t.Fatal("queued call not sent")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,135 @@
+package module
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/console"
+)
+
+type State int32
+
+const (
+	StateRegistered State = iota
+	StateInitializing
+	StateRunning
+	// crashed, waiting for the restart
+	StateRestarting
+	StateStopping
+	StateStopped
+	// crashed and not restarted
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRegistered:
+		return "registered"
+	case StateInitializing:
+		return "initializing"
+	case StateRunning:
+		return "running"
+	case StateRestarting:
+		return "restarting"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	case StateDead:
+		return "dead"
+	}
+	return fmt.Sprintf("state(%d)", int32(s))
+}
+
+// optional, HealthCheck must be goroutine safe, it is called only when the
+// module is running
+type HealthChecker interface {
+	HealthCheck() error
+}
+
+// optional, the queue depths of a module by queue name, it must be
+// goroutine safe. Skeleton implements it.
+type QueueReporter interface {
+	QueueLens() map[string]int
+}
+
+type Info struct {
+	Name     string
+	State    State
+	Uptime   time.Duration // since the last start
+	Restarts uint32
+	Health   error
+	Queues   map[string]int
+}
+
+func init() {
+	console.RegisterFunc("module", "state, uptime, health and queue depths of the modules", func([]string) string {
+		output := "Name - State - Uptime - Restarts - Health - Queues"
+		for _, info := range Modules() {
+			health := "ok"
+			if info.Health != nil {
+				health = info.Health.Error()
+			}
+
+			var queues []string
+			for name, l := range info.Queues {
+				queues = append(queues, fmt.Sprintf("%v %v", name, l))
+			}
+			sort.Strings(queues)
+
+			output += fmt.Sprintf("\r\n%v - %v - %v - %v - %v - %v",
+				info.Name, info.State, info.Uptime.Truncate(time.Second),
+				info.Restarts, health, strings.Join(queues, ", "))
+		}
+		return output
+	})
+}
+
+func (m *module) setState(s State) {
+	if s == StateRunning {
+		atomic.StoreInt64(&m.startTime, time.Now().UnixNano())
+	}
+	atomic.StoreInt32(&m.state, int32(s))
+}
+
+func (m *module) getState() State {
+	return State(atomic.LoadInt32(&m.state))
+}
+
+func (m *module) info() Info {
+	info := Info{
+		Name:     m.name,
+		State:    m.getState(),
+		Restarts: atomic.LoadUint32(&m.restarts),
+	}
+	if info.State != StateRunning {
+		return info
+	}
+
+	info.Uptime = time.Since(time.Unix(0, atomic.LoadInt64(&m.startTime)))
+	if hc, ok := m.mi.(HealthChecker); ok {
+		info.Health = hc.HealthCheck()
+	}
+	if qr, ok := m.mi.(QueueReporter); ok {
+		info.Queues = qr.QueueLens()
+	}
+	return info
+}
+
+// Modules returns the modules in init order
+// goroutine safe
+func Modules() []Info {
+	// HealthCheck may be slow or call back into the package
+	mutexMods.RLock()
+	mods := append([]*module(nil), mods...)
+	mutexMods.RUnlock()
+
+	infos := make([]Info, len(mods))
+	for i, m := range mods {
+		infos[i] = m.info()
+	}
+	return infos
+}
@@ -0,0 +1,142 @@
+package module
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/conf"
+	"github.com/rufeng18/tinyleaf/log"
+)
+
+// what the supervisor does when Run panics
+type Strategy int
+
+const (
+	// restart the module with backoff
+	StrategyRestart Strategy = iota
+	// shut the process down
+	StrategyEscalate
+	// leave the module stopped
+	StrategyStop
+)
+
+type Supervision struct {
+	Strategy   Strategy
+	MinBackoff time.Duration // the first delay of a restart, 1s by default
+	MaxBackoff time.Duration // the delay doubles up to it, 1m by default
+}
+
+// optional, the modules which do not implement it are restarted
+type Supervised interface {
+	Supervision() Supervision
+}
+
+var chanEscalate = make(chan string, 1)
+
+// Escalated receives the name of the module which crashed with
+// StrategyEscalate, the process should shut down
+func Escalated() <-chan string {
+	return chanEscalate
+}
+
+func supervision(mi Module) Supervision {
+	var sv Supervision
+	if s, ok := mi.(Supervised); ok {
+		sv = s.Supervision()
+	}
+	if sv.MinBackoff <= 0 {
+		sv.MinBackoff = time.Second
+	}
+	if sv.MaxBackoff < sv.MinBackoff {
+		sv.MaxBackoff = time.Minute
+		if sv.MaxBackoff < sv.MinBackoff {
+			sv.MaxBackoff = sv.MinBackoff
+		}
+	}
+	return sv
+}
+
+func run(m *module) {
+	defer m.wg.Done()
+
+	backoff := m.supervision.MinBackoff
+	for {
+		start := time.Now()
+		if !runSafe(m) {
+			// Run returned before Destroy
+			atomic.CompareAndSwapInt32(&m.state, int32(StateRunning), int32(StateStopped))
+			return
+		}
+
+		switch m.supervision.Strategy {
+		case StrategyStop:
+			m.setState(StateDead)
+			log.Error("module %v crashed and stopped", m.name)
+			return
+		case StrategyEscalate:
+			m.setState(StateDead)
+			log.Error("module %v crashed, shutting down", m.name)
+			select {
+			case chanEscalate <- m.name:
+			default:
+			}
+			return
+		}
+
+		// it ran long enough to forget the previous crashes
+		if time.Since(start) > m.supervision.MaxBackoff {
+			backoff = m.supervision.MinBackoff
+		}
+		// Run may have crashed after it got closeSig from Destroy
+		if !atomic.CompareAndSwapInt32(&m.state, int32(StateRunning), int32(StateRestarting)) {
+			log.Error("module %v crashed while stopping", m.name)
+			return
+		}
+		log.Release("module %v crashed, restart in %v", m.name, backoff)
+
+		select {
+		case <-m.closeSig:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > m.supervision.MaxBackoff {
+			backoff = m.supervision.MaxBackoff
+		}
+		if !m.restart() {
+			return
+		}
+	}
+}
+
+// restart sets StateRunning, false if Destroy has started meanwhile
+func (m *module) restart() bool {
+	atomic.StoreInt64(&m.startTime, time.Now().UnixNano())
+	if !atomic.CompareAndSwapInt32(&m.state, int32(StateRestarting), int32(StateRunning)) {
+		return false
+	}
+	atomic.AddUint32(&m.restarts, 1)
+	return true
+}
+
+// runSafe returns true if Run panics
+func runSafe(m *module) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			crashed = true
+
+			l := conf.LenStackBuf
+			if l <= 0 {
+				l = 4096
+			}
+			buf := make([]byte, l)
+			l = runtime.Stack(buf, false)
+			log.Error("module %v: %v: %s", m.name, r, buf[:l])
+		}
+	}()
+
+	m.mi.Run(m.closeSig)
+	return
+}
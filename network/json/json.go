@@ -96,6 +96,16 @@ func (p *Processor) SetRawHandler(msgID string, msgRawHandler MsgHandler) {
 
 // goroutine safe
 func (p *Processor) Route(msg interface{}, userData interface{}) error {
+	return p.route(msg, userData, true)
+}
+
+// TryRoute implements network.TryRouter
+// goroutine safe
+func (p *Processor) TryRoute(msg interface{}, userData interface{}) error {
+	return p.route(msg, userData, false)
+}
+
+func (p *Processor) route(msg interface{}, userData interface{}, block bool) error {
 	// raw
 	if msgRaw, ok := msg.(MsgRaw); ok {
 		i, ok := p.msgInfo[msgRaw.msgID]
@@ -122,7 +132,11 @@ func (p *Processor) Route(msg interface{}, userData interface{}) error {
 		i.msgHandler([]interface{}{msg, userData})
 	}
 	if i.msgRouter != nil {
-		i.msgRouter.Go(msgType, msg, userData)
+		if block {
+			i.msgRouter.Go(msgType, msg, userData)
+		} else if err := i.msgRouter.TryGo(msgType, msg, userData); err != nil {
+			return fmt.Errorf("message %v dropped: %v", msgID, err)
+		}
 	}
 	return nil
 }
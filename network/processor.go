@@ -8,3 +8,10 @@ type Processor interface {
 	// must goroutine safe
 	Marshal(msg interface{}) ([][]byte, error)
 }
+
+// optional, Route without blocking on a full router, the message is dropped
+// and an error returned instead
+type TryRouter interface {
+	// must goroutine safe
+	TryRoute(msg interface{}, userData interface{}) error
+}
@@ -101,6 +101,16 @@ func (p *Processor) SetRawHandler(id uint16, msgRawHandler MsgHandler) {
 
 // goroutine safe
 func (p *Processor) Route(msg interface{}, userData interface{}) error {
+	return p.route(msg, userData, true)
+}
+
+// TryRoute implements network.TryRouter
+// goroutine safe
+func (p *Processor) TryRoute(msg interface{}, userData interface{}) error {
+	return p.route(msg, userData, false)
+}
+
+func (p *Processor) route(msg interface{}, userData interface{}, block bool) error {
 	// raw
 	if msgRaw, ok := msg.(MsgRaw); ok {
 		if msgRaw.msgID >= uint16(len(p.msgInfo)) {
@@ -124,7 +134,11 @@ func (p *Processor) Route(msg interface{}, userData interface{}) error {
 		i.msgHandler([]interface{}{msg, userData})
 	}
 	if i.msgRouter != nil {
-		i.msgRouter.Go(msgType, msg, userData)
+		if block {
+			i.msgRouter.Go(msgType, msg, userData)
+		} else if err := i.msgRouter.TryGo(msgType, msg, userData); err != nil {
+			return fmt.Errorf("message %s dropped: %v", msgType, err)
+		}
 	}
 	return nil
 }
@@ -73,7 +73,7 @@ func (client *TCPClient) init() {
 func (client *TCPClient) dial() net.Conn {
 	for {
 		conn, err := net.Dial("tcp", client.Addr)
-		if err == nil || client.closeFlag {
+		if err == nil || client.closed() {
 			return conn
 		}
 
@@ -112,12 +112,19 @@ reconnect:
 	client.Unlock()
 	agent.OnClose()
 
-	if client.AutoReconnect {
+	if client.AutoReconnect && !client.closed() {
 		time.Sleep(client.ConnectInterval)
 		goto reconnect
 	}
 }
 
+// Close may be called while dialing
+func (client *TCPClient) closed() bool {
+	client.Lock()
+	defer client.Unlock()
+	return client.closeFlag
+}
+
 func (client *TCPClient) Close() {
 	client.Lock()
 	client.closeFlag = true
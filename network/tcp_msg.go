@@ -114,17 +114,13 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 		return nil, errors.New("message too short")
 	}
 
-	fmt.Println("tcp_msg.go.MsgParse.Read rawDate Len:", msgLen)
-
 	// data
 	msgData := make([]byte, msgLen)
 	if _, err := io.ReadFull(conn, msgData); err != nil {
 		return nil, err
 	}
 
-	fmt.Println("tcp_msg.go.MsgParse.Read msgData:", msgData)
 	bodyData := msgData[p.lenExtHeadLen:] // 跳过消息头
-	fmt.Println("tcp_msg.go.MsgParse.Read bodyData:", string(bodyData))
 	// decrypt data
 	if p.encrypt {
 		decrypt_data := xxtea.Decrypt(bodyData, []byte(ENCRYPT_KEY))
@@ -136,7 +132,6 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 
 // goroutine safe
 func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
-	fmt.Println("tcp_msg.go.MsgParse.Write", conn, args)
 	// get len
 	var msgLen uint32
 	for i := 0; i < len(args); i++ {
@@ -180,7 +175,6 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 		l += len(args[i])
 	}
 
-	fmt.Println("tcp_msg.go.MsgParse.Write Data Len:", l)
 	conn.Write(msg)
 
 	return nil
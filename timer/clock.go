@@ -0,0 +1,157 @@
+package timer
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of a dispatcher
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f after d, f must not block
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+type ClockTimer interface {
+	// Stop returns false if f has been called or the timer is stopped
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// SystemClock is the default clock, backed by package time
+var SystemClock Clock = systemClock{}
+
+// Hold is called by a callback of AfterFunc which hands the timer over to
+// another goroutine, that goroutine calls the function returned once it has
+// handled the timer. FakeClock.Advance waits for it before it moves on, the
+// function does nothing for the other clocks.
+func Hold(c Clock) func() {
+	if fc, ok := c.(*FakeClock); ok {
+		return fc.hold()
+	}
+	return func() {}
+}
+
+// FakeClock is a clock for tests, the time only moves by Advance
+// goroutine safe
+type FakeClock struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond // signaled when held drops to 0
+	now    time.Time
+	seq    uint64
+	timers map[*fakeTimer]bool
+	held   int
+}
+
+type fakeTimer struct {
+	c    *FakeClock
+	when time.Time
+	seq  uint64
+	f    func()
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := new(FakeClock)
+	c.cond = sync.NewCond(&c.mutex)
+	c.now = now
+	c.timers = make(map[*fakeTimer]bool)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.seq++
+	t := &fakeTimer{c: c, when: c.now.Add(d), seq: c.seq, f: f}
+	c.timers[t] = true
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mutex.Lock()
+	defer t.c.mutex.Unlock()
+
+	if !t.c.timers[t] {
+		return false
+	}
+	delete(t.c.timers, t)
+	return true
+}
+
+func (c *FakeClock) hold() func() {
+	c.mutex.Lock()
+	c.held++
+	c.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mutex.Lock()
+			c.held--
+			if c.held == 0 {
+				c.cond.Broadcast()
+			}
+			c.mutex.Unlock()
+		})
+	}
+}
+
+// Advance moves the time forward by d, the timers due are fired one by one
+// in time order, each with the time set to its due time. A timer held by its
+// callback (see Hold) is handled before the next one is fired, so the timers
+// started meanwhile are fired in order too. Otherwise the callbacks of a
+// dispatcher run later on its goroutine, the timers they start are fired by
+// the next Advance if they are already due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	c.mutex.Unlock()
+
+	for {
+		c.mutex.Lock()
+		var next *fakeTimer
+		for t := range c.timers {
+			if t.when.After(end) {
+				continue
+			}
+			if next == nil || t.when.Before(next.when) || t.when.Equal(next.when) && t.seq < next.seq {
+				next = t
+			}
+		}
+		if next == nil {
+			c.now = end
+			c.mutex.Unlock()
+			return
+		}
+
+		delete(c.timers, next)
+		if next.when.After(c.now) {
+			c.now = next.when
+		}
+		c.mutex.Unlock()
+
+		next.f()
+
+		c.mutex.Lock()
+		for c.held > 0 {
+			c.cond.Wait()
+		}
+		c.mutex.Unlock()
+	}
+}
@@ -14,9 +14,25 @@ import (
 // Seconds      | No         | 0-59           | * / , -
 // Minutes      | Yes        | 0-59           | * / , -
 // Hours        | Yes        | 0-23           | * / , -
-// Day of month | Yes        | 1-31           | * / , -
+// Day of month | Yes        | 1-31           | * / , - ? L W
 // Month        | Yes        | 1-12           | * / , -
-// Day of week  | Yes        | 0-6            | * / , -
+// Day of week  | Yes        | 0-6            | * / , - ? L #
+//
+// L    the last day of the month
+// nW   the weekday (Monday to Friday) nearest to the day n, within the month
+// LW   the last weekday of the month
+// nL   the last day of week n of the month, 5L is the last Friday
+// n#i  the i-th day of week n of the month, 1#2 is the second Monday
+// ?    the same as *
+//
+// The expression may start with TZ=<location> (or CRON_TZ=<location>) such
+// as TZ=Asia/Shanghai, it is evaluated in the location of the time given to
+// Next otherwise. A time skipped when the clocks go forward runs at the
+// change, a time repeated when the clocks go back runs once.
+//
+// Macros:
+// @yearly (or @annually), @monthly, @weekly, @daily (or @midnight), @hourly
+// @every <duration> such as @every 1h30m, at least one second
 type CronExpr struct {
 	sec   uint64
 	min   uint64
@@ -24,11 +40,68 @@ type CronExpr struct {
 	dom   uint64
 	month uint64
 	dow   uint64
+
+	loc   *time.Location
+	every time.Duration
+
+	// day specials
+	lastDom        bool   // L
+	lastWeekdayDom bool   // LW
+	weekdayDom     uint64 // nW
+	lastDow        uint64 // nL
+	nthDow         [7]uint8
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
 }
 
 // goroutine safe
 func NewCronExpr(expr string) (cronExpr *CronExpr, err error) {
 	fields := strings.Fields(expr)
+
+	var loc *time.Location
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "TZ=") || strings.HasPrefix(fields[0], "CRON_TZ=")) {
+		name := fields[0][strings.Index(fields[0], "=")+1:]
+		loc, err = time.LoadLocation(name)
+		if err != nil {
+			err = fmt.Errorf("invalid expr %v: %v", expr, err)
+			return
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		if fields[0] == "@every" {
+			if len(fields) != 2 {
+				err = fmt.Errorf("invalid expr %v: expected @every <duration>", expr)
+				return
+			}
+			var d time.Duration
+			d, err = time.ParseDuration(fields[1])
+			if err != nil || d < time.Second {
+				err = fmt.Errorf("invalid expr %v: invalid duration %v", expr, fields[1])
+				return
+			}
+			cronExpr = new(CronExpr)
+			cronExpr.every = d
+			return
+		}
+
+		macro, ok := cronMacros[fields[0]]
+		if !ok || len(fields) != 1 {
+			err = fmt.Errorf("invalid expr %v: unknown macro %v", expr, fields[0])
+			return
+		}
+		fields = strings.Fields(macro)
+	}
+
 	if len(fields) != 5 && len(fields) != 6 {
 		err = fmt.Errorf("invalid expr %v: expected 5 or 6 fields, got %v", expr, len(fields))
 		return
@@ -39,6 +112,7 @@ func NewCronExpr(expr string) (cronExpr *CronExpr, err error) {
 	}
 
 	cronExpr = new(CronExpr)
+	cronExpr.loc = loc
 	// Seconds
 	cronExpr.sec, err = parseCronField(fields[0], 0, 59)
 	if err != nil {
@@ -55,7 +129,7 @@ func NewCronExpr(expr string) (cronExpr *CronExpr, err error) {
 		goto onError
 	}
 	// Day of month
-	cronExpr.dom, err = parseCronField(fields[3], 1, 31)
+	err = cronExpr.parseDom(fields[3])
 	if err != nil {
 		goto onError
 	}
@@ -65,17 +139,83 @@ func NewCronExpr(expr string) (cronExpr *CronExpr, err error) {
 		goto onError
 	}
 	// Day of week
-	cronExpr.dow, err = parseCronField(fields[5], 0, 6)
+	err = cronExpr.parseDow(fields[5])
 	if err != nil {
 		goto onError
 	}
 	return
 
 onError:
+	cronExpr = nil
 	err = fmt.Errorf("invalid expr %v: %v", expr, err)
 	return
 }
 
+func (e *CronExpr) parseDom(field string) error {
+	var fields []string
+	for _, f := range strings.Split(field, ",") {
+		switch {
+		case f == "?":
+			fields = append(fields, "*")
+		case f == "L":
+			e.lastDom = true
+		case f == "LW":
+			e.lastWeekdayDom = true
+		case strings.HasSuffix(f, "W"):
+			day, err := strconv.Atoi(f[:len(f)-1])
+			if err != nil || day < 1 || day > 31 {
+				return fmt.Errorf("invalid weekday: %v", f)
+			}
+			e.weekdayDom |= 1 << uint(day)
+		default:
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var err error
+	e.dom, err = parseCronField(strings.Join(fields, ","), 1, 31)
+	return err
+}
+
+func (e *CronExpr) parseDow(field string) error {
+	var fields []string
+	for _, f := range strings.Split(field, ",") {
+		switch {
+		case f == "?":
+			fields = append(fields, "*")
+		case len(f) > 1 && strings.HasSuffix(f, "L"):
+			dow, err := strconv.Atoi(f[:len(f)-1])
+			if err != nil || dow < 0 || dow > 6 {
+				return fmt.Errorf("invalid last weekday: %v", f)
+			}
+			e.lastDow |= 1 << uint(dow)
+		case strings.Contains(f, "#"):
+			dowAndNth := strings.Split(f, "#")
+			if len(dowAndNth) != 2 {
+				return fmt.Errorf("invalid nth weekday: %v", f)
+			}
+			dow, err1 := strconv.Atoi(dowAndNth[0])
+			nth, err2 := strconv.Atoi(dowAndNth[1])
+			if err1 != nil || err2 != nil || dow < 0 || dow > 6 || nth < 1 || nth > 5 {
+				return fmt.Errorf("invalid nth weekday: %v", f)
+			}
+			e.nthDow[dow] |= 1 << uint(nth)
+		default:
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var err error
+	e.dow, err = parseCronField(strings.Join(fields, ","), 0, 6)
+	return err
+}
+
 // 1. *
 // 2. num
 // 3. num-num
@@ -171,23 +311,153 @@ func parseCronField(field string, min int, max int) (cronField uint64, err error
 	return
 }
 
+func (e *CronExpr) matchDom(t time.Time) bool {
+	day := t.Day()
+	if 1<<uint(day)&e.dom != 0 {
+		return true
+	}
+
+	last := lastDay(t)
+	if e.lastDom && day == last {
+		return true
+	}
+	if e.lastWeekdayDom && day == nearestWeekday(t, last, last) {
+		return true
+	}
+	if e.weekdayDom != 0 {
+		for n := 1; n <= last; n++ {
+			if 1<<uint(n)&e.weekdayDom != 0 && day == nearestWeekday(t, n, last) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *CronExpr) matchDow(t time.Time) bool {
+	dow := t.Weekday()
+	if 1<<uint(dow)&e.dow != 0 {
+		return true
+	}
+
+	day := t.Day()
+	if 1<<uint(dow)&e.lastDow != 0 && day+7 > lastDay(t) {
+		return true
+	}
+	return 1<<uint((day-1)/7+1)&e.nthDow[dow] != 0
+}
+
 func (e *CronExpr) matchDay(t time.Time) bool {
 	// day-of-month blank
 	if e.dom == 0xfffffffe {
-		return 1<<uint(t.Weekday())&e.dow != 0
+		return e.matchDow(t)
 	}
 
 	// day-of-week blank
 	if e.dow == 0x7f {
-		return 1<<uint(t.Day())&e.dom != 0
+		return e.matchDom(t)
 	}
 
-	return 1<<uint(t.Weekday())&e.dow != 0 ||
-		1<<uint(t.Day())&e.dom != 0
+	return e.matchDow(t) || e.matchDom(t)
+}
+
+// the last day of the month of t
+func lastDay(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// the day of the weekday nearest to the day n of the month of t, within the
+// month
+func nearestWeekday(t time.Time, n int, last int) int {
+	switch time.Date(t.Year(), t.Month(), n, 0, 0, 0, 0, time.UTC).Weekday() {
+	case time.Saturday:
+		if n == 1 {
+			return n + 2
+		}
+		return n - 1
+	case time.Sunday:
+		if n == last {
+			return n - 2
+		}
+		return n + 1
+	}
+	return n
 }
 
 // goroutine safe
 func (e *CronExpr) Next(t time.Time) time.Time {
+	if e.every > 0 {
+		return t.Truncate(time.Second).Add(e.every)
+	}
+
+	loc := e.loc
+	if loc == nil {
+		loc = t.Location()
+	}
+
+	// the local time in UTC, which has no clock changes
+	lt := t.In(loc)
+	w := time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), lt.Minute(), lt.Second(), lt.Nanosecond(), time.UTC)
+	for {
+		w = e.next(w)
+		if w.IsZero() {
+			return w
+		}
+		// not after t in the second pass of a repeated time
+		if next := localToTime(w, loc); next.After(t) {
+			return next
+		}
+	}
+}
+
+// NextN returns the next n times after t, fewer if there are no more
+// goroutine safe
+func (e *CronExpr) NextN(t time.Time, n int) []time.Time {
+	var times []time.Time
+	for i := 0; i < n; i++ {
+		t = e.Next(t)
+		if t.IsZero() {
+			break
+		}
+		times = append(times, t)
+	}
+	return times
+}
+
+// localToTime returns the first time whose local time in loc is not before
+// w, w holds the local time in UTC
+func localToTime(w time.Time, loc *time.Location) time.Time {
+	// the offsets around, there is at most one clock change between
+	_, before := w.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := w.Add(24 * time.Hour).In(loc).Zone()
+
+	var first time.Time
+	for _, offset := range []int{before, after} {
+		t := w.Add(-time.Duration(offset) * time.Second)
+		if _, o := t.In(loc).Zone(); o == offset && (first.IsZero() || t.Before(first)) {
+			first = t
+		}
+	}
+	if !first.IsZero() {
+		return first.In(loc)
+	}
+
+	// skipped, the clocks go forward between lo and hi
+	lo := w.Unix() - int64(after)
+	hi := w.Unix() - int64(before)
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if _, o := time.Unix(mid, 0).In(loc).Zone(); o == before {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return time.Unix(hi, 0).In(loc)
+}
+
+// the next local time matched after t, in UTC
+func (e *CronExpr) next(t time.Time) time.Time {
 	// the upcoming second
 	t = t.Truncate(time.Second).Add(time.Second)
 
@@ -0,0 +1,102 @@
+package timer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/timer"
+)
+
+func TestCronExpr(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	date := func(year int, month time.Month, day, hour, min int, loc *time.Location) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+
+	tests := []struct {
+		expr string
+		from time.Time
+		next []time.Time
+	}{
+		// region midnight for a server in UTC
+		{"TZ=Asia/Shanghai 0 0 * * *", date(2021, 1, 1, 0, 0, time.UTC), []time.Time{
+			date(2021, 1, 1, 16, 0, time.UTC),
+			date(2021, 1, 2, 16, 0, time.UTC),
+		}},
+		// the clocks go forward at 2:00, 2:30 runs at the change
+		{"CRON_TZ=America/New_York 30 2 * * *", date(2021, 3, 13, 12, 0, ny), []time.Time{
+			date(2021, 3, 14, 3, 0, ny),
+			date(2021, 3, 15, 2, 30, ny),
+		}},
+		// the clocks go back at 2:00, 1:30 runs once
+		{"TZ=America/New_York 30 1 * * *", date(2021, 11, 6, 12, 0, ny), []time.Time{
+			date(2021, 11, 7, 5, 30, time.UTC),
+			date(2021, 11, 8, 1, 30, ny),
+		}},
+		{"TZ=America/New_York 0 * * * *", date(2021, 11, 7, 0, 30, ny), []time.Time{
+			date(2021, 11, 7, 5, 0, time.UTC),
+			date(2021, 11, 7, 7, 0, time.UTC),
+		}},
+		// the second pass of the repeated hour
+		{"TZ=America/New_York 45 1 * * *", date(2021, 11, 7, 6, 30, time.UTC), []time.Time{
+			date(2021, 11, 8, 1, 45, ny),
+		}},
+		{"0 0 L * ?", date(2024, 1, 15, 0, 0, time.UTC), []time.Time{
+			date(2024, 1, 31, 0, 0, time.UTC),
+			date(2024, 2, 29, 0, 0, time.UTC),
+		}},
+		// 2021-05-01 is a Saturday, 2021-05-31 a Monday
+		{"0 0 1W,LW * ?", date(2021, 4, 30, 0, 0, time.UTC), []time.Time{
+			date(2021, 5, 3, 0, 0, time.UTC),
+			date(2021, 5, 31, 0, 0, time.UTC),
+			date(2021, 6, 1, 0, 0, time.UTC),
+		}},
+		// 2021-10-31 is a Sunday
+		{"0 0 LW * ?", date(2021, 10, 1, 0, 0, time.UTC), []time.Time{
+			date(2021, 10, 29, 0, 0, time.UTC),
+		}},
+		{"0 0 ? * 1#2", date(2021, 1, 1, 0, 0, time.UTC), []time.Time{
+			date(2021, 1, 11, 0, 0, time.UTC),
+			date(2021, 2, 8, 0, 0, time.UTC),
+		}},
+		{"0 0 ? * 5L", date(2021, 1, 1, 0, 0, time.UTC), []time.Time{
+			date(2021, 1, 29, 0, 0, time.UTC),
+			date(2021, 2, 26, 0, 0, time.UTC),
+		}},
+		{"@daily", date(2021, 1, 1, 12, 0, time.UTC), []time.Time{
+			date(2021, 1, 2, 0, 0, time.UTC),
+		}},
+		{"@hourly", date(2021, 1, 1, 12, 0, time.UTC), []time.Time{
+			date(2021, 1, 1, 13, 0, time.UTC),
+		}},
+		{"@every 5m", date(2021, 1, 1, 12, 0, time.UTC), []time.Time{
+			date(2021, 1, 1, 12, 5, time.UTC),
+			date(2021, 1, 1, 12, 10, time.UTC),
+		}},
+	}
+
+	for _, test := range tests {
+		cronExpr, err := timer.NewCronExpr(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := cronExpr.NextN(test.from, len(test.next))
+		if len(next) != len(test.next) {
+			t.Fatalf("%v: next %v", test.expr, next)
+		}
+		for i := range next {
+			if !next[i].Equal(test.next[i]) {
+				t.Fatalf("%v: next %v, expected %v", test.expr, next, test.next)
+			}
+		}
+	}
+
+	for _, expr := range []string{"TZ=Nowhere 0 0 * * *", "@every 1ms", "@weekly 0", "@never", "0 0 32W * ?", "0 0 ? * 1#6", "0 0 ? * 7L", "0 0 ? * L"} {
+		if _, err := timer.NewCronExpr(expr); err == nil {
+			t.Fatalf("%v: no error", expr)
+		}
+	}
+}
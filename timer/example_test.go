@@ -66,3 +66,75 @@ func ExampleCron() {
 	// Output:
 	// My name is Leaf
 }
+
+func ExampleFakeClock() {
+	clock := timer.NewFakeClock(time.Date(2000, 1, 1, 23, 59, 0, 0, time.UTC))
+	d := timer.NewDispatcher(10)
+	d.SetClock(clock)
+
+	d.AfterFunc(30*time.Second, func() {
+		fmt.Println("timeout")
+	})
+
+	cronExpr, err := timer.NewCronExpr("0 0 * * *")
+	if err != nil {
+		return
+	}
+	d.CronFunc(cronExpr, func() {
+		fmt.Println("daily reset")
+	})
+
+	clock.Advance(10 * time.Second)
+	fmt.Println(len(d.ChanTimer))
+
+	clock.Advance(time.Minute)
+	(<-d.ChanTimer).Cb()
+	(<-d.ChanTimer).Cb()
+
+	// the next reset is started by the callback, the one missed meanwhile
+	// is skipped
+	clock.Advance(48 * time.Hour)
+	(<-d.ChanTimer).Cb()
+	fmt.Println(len(d.ChanTimer), clock.Now())
+
+	// Output:
+	// 0
+	// timeout
+	// daily reset
+	// daily reset
+	// 0 2000-01-04 00:00:10 +0000 UTC
+}
+
+func ExampleDispatcher_Every() {
+	clock := timer.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := timer.NewDispatcher(10)
+	d.SetClock(clock)
+
+	n := 0
+	var t *timer.Timer
+	t = d.Every(time.Second, func() {
+		n++
+		fmt.Println("tick", n)
+		if n == 2 {
+			t.Pause()
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		clock.Advance(time.Second)
+		(<-d.ChanTimer).Cb()
+	}
+	fmt.Println(t.Paused(), t.Remaining())
+
+	clock.Advance(time.Hour)
+	t.Resume()
+	clock.Advance(time.Second)
+	(<-d.ChanTimer).Cb()
+	t.Stop()
+
+	// Output:
+	// tick 1
+	// tick 2
+	// true 1s
+	// tick 3
+}
@@ -11,28 +11,185 @@ import (
 // one dispatcher per goroutine (goroutine not safe)
 type Dispatcher struct {
 	ChanTimer chan *Timer
+	clock     Clock
+	wheel     *wheel
+	hold      bool
 }
 
 func NewDispatcher(l int) *Dispatcher {
 	disp := new(Dispatcher)
 	disp.ChanTimer = make(chan *Timer, l)
+	disp.clock = SystemClock
 	return disp
 }
 
+// NewWheelDispatcher returns a dispatcher backed by a timing wheel with the
+// resolution tick, instead of a runtime timer per Timer. ChanTimer is not
+// used, the timers are fired by Advance.
+func NewWheelDispatcher(tick time.Duration) *Dispatcher {
+	if tick <= 0 {
+		panic("invalid tick")
+	}
+
+	disp := new(Dispatcher)
+	disp.clock = SystemClock
+	disp.wheel = newWheel(tick)
+	return disp
+}
+
+// Advance fires the timers of a wheel dispatcher which are due
+func (disp *Dispatcher) Advance() {
+	disp.wheel.advance(disp.clock.Now())
+}
+
+// the resolution of a wheel dispatcher, 0 otherwise
+func (disp *Dispatcher) Tick() time.Duration {
+	if disp.wheel == nil {
+		return 0
+	}
+	return disp.wheel.tick
+}
+
+// you must call the function before calling AfterFunc and CronFunc
+func (disp *Dispatcher) SetClock(c Clock) {
+	disp.clock = c
+}
+
+func (disp *Dispatcher) Clock() Clock {
+	return disp.clock
+}
+
+// SetHold makes FakeClock.Advance wait for Cb of each timer it fires, so
+// ChanTimer must be served by another goroutine. It has no effect with the
+// other clocks, you must call it after SetClock.
+func (disp *Dispatcher) SetHold(hold bool) {
+	_, fake := disp.clock.(*FakeClock)
+	disp.hold = hold && fake
+}
+
 // Timer
+// the methods must be called on the goroutine of the dispatcher
 type Timer struct {
-	t  *time.Timer
-	cb func()
+	disp     *Dispatcher
+	t        ClockTimer
+	cb       func()
+	interval time.Duration // repeating if > 0
+
+	armed     bool
+	when      time.Time
+	paused    bool
+	remaining time.Duration // when paused
+	stale     int           // fired by the clock but stopped since
+	done      func()        // see SetHold
+
+	// wheel
+	prev, next *Timer
+	expires    uint64
+}
+
+func (t *Timer) start(now time.Time, d time.Duration) {
+	t.armed = true
+	t.when = now.Add(d)
+	disp := t.disp
+	if disp.wheel != nil {
+		disp.wheel.schedule(t, now, d)
+		return
+	}
+	t.t = disp.clock.AfterFunc(d, func() {
+		if disp.hold {
+			t.done = Hold(disp.clock)
+		}
+		disp.ChanTimer <- t
+	})
+}
+
+func (t *Timer) stop() {
+	if t.t != nil && !t.t.Stop() {
+		// already in ChanTimer
+		t.stale++
+	}
+	t.t = nil
+	t.unlink()
+	t.armed = false
 }
 
 func (t *Timer) Stop() {
-	t.t.Stop()
-	t.cb = nil
+	t.stop()
+	t.paused = false
+}
+
+// Reset stops the timer and starts it again to fire after d, a repeating
+// timer goes on every interval from then
+func (t *Timer) Reset(d time.Duration) {
+	t.Stop()
+	t.start(t.disp.clock.Now(), d)
+}
+
+// Pause stops the timer and keeps the remaining time for Resume
+func (t *Timer) Pause() {
+	if !t.armed {
+		return
+	}
+	t.remaining = t.Remaining()
+	t.stop()
+	t.paused = true
+}
+
+func (t *Timer) Resume() {
+	if !t.paused {
+		return
+	}
+	t.paused = false
+	t.start(t.disp.clock.Now(), t.remaining)
+}
+
+func (t *Timer) Paused() bool {
+	return t.paused
+}
+
+// Remaining returns the time before the timer fires, 0 if it is stopped or
+// fired
+func (t *Timer) Remaining() time.Duration {
+	if t.paused {
+		return t.remaining
+	}
+	if !t.armed {
+		return 0
+	}
+	d := t.when.Sub(t.disp.clock.Now())
+	if d < 0 {
+		d = 0
+	}
+	return d
 }
 
 func (t *Timer) Cb() {
+	if done := t.done; done != nil {
+		t.done = nil
+		defer done()
+	}
+	if t.stale > 0 {
+		t.stale--
+		return
+	}
+	t.t = nil
+	if !t.armed {
+		return
+	}
+
+	if t.interval > 0 {
+		// from the due time, the missed intervals are skipped
+		now := t.disp.clock.Now()
+		next := t.when.Add(t.interval)
+		if !next.After(now) {
+			next = next.Add((now.Sub(next)/t.interval + 1) * t.interval)
+		}
+		t.start(now, next.Sub(now))
+	} else {
+		t.armed = false
+	}
+
 	defer func() {
-		t.cb = nil
 		if r := recover(); r != nil {
 			if conf.LenStackBuf > 0 {
 				buf := make([]byte, conf.LenStackBuf)
@@ -51,10 +208,23 @@ func (t *Timer) Cb() {
 
 func (disp *Dispatcher) AfterFunc(d time.Duration, cb func()) *Timer {
 	t := new(Timer)
+	t.disp = disp
 	t.cb = cb
-	t.t = time.AfterFunc(d, func() {
-		disp.ChanTimer <- t
-	})
+	t.start(disp.clock.Now(), d)
+	return t
+}
+
+// Every calls cb every interval until the timer is stopped
+func (disp *Dispatcher) Every(interval time.Duration, cb func()) *Timer {
+	if interval <= 0 {
+		panic("invalid interval")
+	}
+
+	t := new(Timer)
+	t.disp = disp
+	t.cb = cb
+	t.interval = interval
+	t.start(disp.clock.Now(), interval)
 	return t
 }
 
@@ -72,7 +242,7 @@ func (c *Cron) Stop() {
 func (disp *Dispatcher) CronFunc(cronExpr *CronExpr, _cb func()) *Cron {
 	c := new(Cron)
 
-	now := time.Now()
+	now := disp.clock.Now()
 	nextTime := cronExpr.Next(now)
 	if nextTime.IsZero() {
 		return c
@@ -83,8 +253,14 @@ func (disp *Dispatcher) CronFunc(cronExpr *CronExpr, _cb func()) *Cron {
 	cb = func() {
 		defer _cb()
 
-		now := time.Now()
-		nextTime := cronExpr.Next(now)
+		// the times missed by a late callback are skipped, a clock behind the
+		// due time must not run it twice
+		now := disp.clock.Now()
+		from := now
+		if from.Before(nextTime) {
+			from = nextTime
+		}
+		nextTime = cronExpr.Next(from)
 		if nextTime.IsZero() {
 			return
 		}
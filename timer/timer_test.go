@@ -0,0 +1,130 @@
+package timer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/timer"
+)
+
+func TestTimerControl(t *testing.T) {
+	for _, wheel := range []bool{false, true} {
+		clock := timer.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+		var d *timer.Dispatcher
+		if wheel {
+			d = timer.NewWheelDispatcher(10 * time.Millisecond)
+		} else {
+			d = timer.NewDispatcher(10)
+		}
+		d.SetClock(clock)
+
+		dispatch := func() {
+			if wheel {
+				d.Advance()
+				return
+			}
+			for len(d.ChanTimer) > 0 {
+				(<-d.ChanTimer).Cb()
+			}
+		}
+		step := func(n int) {
+			for i := 0; i < n; i++ {
+				clock.Advance(time.Second)
+				dispatch()
+			}
+		}
+
+		var ticks, fired int
+		every := d.Every(time.Second, func() {
+			ticks++
+		})
+		once := d.AfterFunc(5*time.Second, func() {
+			fired++
+		})
+
+		step(2)
+		if ticks != 2 || once.Remaining() != 3*time.Second {
+			t.Fatalf("wheel %v: ticks %v, remaining %v", wheel, ticks, once.Remaining())
+		}
+
+		once.Pause()
+		step(5)
+		if fired != 0 || !once.Paused() || once.Remaining() != 3*time.Second {
+			t.Fatalf("wheel %v: paused timer fired %v, remaining %v", wheel, fired, once.Remaining())
+		}
+
+		once.Resume()
+		step(2)
+		if fired != 0 || once.Remaining() != time.Second {
+			t.Fatalf("wheel %v: resumed timer fired %v, remaining %v", wheel, fired, once.Remaining())
+		}
+		once.Reset(2 * time.Second)
+		step(1)
+		if fired != 0 {
+			t.Fatalf("wheel %v: reset timer fired early", wheel)
+		}
+		step(1)
+		if fired != 1 || once.Remaining() != 0 {
+			t.Fatalf("wheel %v: reset timer fired %v, remaining %v", wheel, fired, once.Remaining())
+		}
+
+		if ticks != 11 {
+			t.Fatalf("wheel %v: ticks %v", wheel, ticks)
+		}
+		every.Stop()
+		step(2)
+		if ticks != 11 {
+			t.Fatalf("wheel %v: stopped timer ticks %v", wheel, ticks)
+		}
+
+		// reset while the timer is waiting for dispatch
+		once.Reset(time.Second)
+		clock.Advance(time.Second)
+		once.Reset(time.Second)
+		dispatch()
+		if fired != 1 {
+			t.Fatalf("wheel %v: stale timer fired", wheel)
+		}
+		step(1)
+		if fired != 2 {
+			t.Fatalf("wheel %v: reset timer fired %v", wheel, fired)
+		}
+	}
+}
+
+func TestDispatcherHold(t *testing.T) {
+	clock := timer.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := timer.NewDispatcher(10)
+	d.SetClock(clock)
+	d.SetHold(true)
+
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case t := <-d.ChanTimer:
+				t.Cb()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// the timers started by a callback are fired by the same Advance, each
+	// at its due time
+	var times []time.Time
+	var cb func()
+	cb = func() {
+		times = append(times, clock.Now())
+		if len(times) < 3 {
+			d.AfterFunc(time.Second, cb)
+		}
+	}
+	d.AfterFunc(time.Second, cb)
+	clock.Advance(time.Minute)
+
+	if len(times) != 3 || times[2] != time.Date(2000, 1, 1, 0, 0, 3, 0, time.UTC) {
+		t.Fatalf("fired at %v", times)
+	}
+}
@@ -0,0 +1,187 @@
+package timer
+
+import (
+	"math/bits"
+	"time"
+)
+
+// a hierarchical timing wheel, the first level has a slot per tick and each
+// of the other levels has a slot per turn of the level below, the timers
+// cascade down as the wheel turns
+const (
+	wheelBits0  = 8
+	wheelBitsN  = 6
+	wheelSize0  = 1 << wheelBits0
+	wheelSizeN  = 1 << wheelBitsN
+	wheelMask0  = wheelSize0 - 1
+	wheelMaskN  = wheelSizeN - 1
+	wheelLevels = 4 // besides the first
+	wheelMax    = 1<<(wheelBits0+wheelLevels*wheelBitsN) - 1
+)
+
+type wheel struct {
+	tick   time.Duration
+	start  time.Time
+	cur    uint64 // the next tick to run
+	level0 [wheelSize0]Timer
+	levels [wheelLevels][wheelSizeN]Timer
+	// the slots of the first level which may have timers, so that advance
+	// jumps over the empty ones
+	bitmap [wheelSize0 / 64]uint64
+}
+
+func newWheel(tick time.Duration) *wheel {
+	w := new(wheel)
+	w.tick = tick
+	for i := range w.level0 {
+		w.level0[i].init()
+	}
+	for i := range w.levels {
+		for j := range w.levels[i] {
+			w.levels[i][j].init()
+		}
+	}
+	return w
+}
+
+// the slots are list heads
+func (t *Timer) init() {
+	t.prev = t
+	t.next = t
+}
+
+func (t *Timer) unlink() {
+	if t.next == nil {
+		return
+	}
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev = nil
+	t.next = nil
+}
+
+func (w *wheel) slot(t *Timer) *Timer {
+	e := t.expires
+	if e < w.cur {
+		// late, it runs on the next tick
+		e = w.cur
+	}
+	idx := e - w.cur
+	if idx > wheelMax {
+		// beyond the range, it is rescheduled when the slot expires
+		idx = wheelMax
+		e = w.cur + wheelMax
+		t.expires = e
+	}
+	if idx < wheelSize0 {
+		index := e & wheelMask0
+		w.bitmap[index>>6] |= 1 << (index & 63)
+		return &w.level0[index]
+	}
+
+	for i := 0; i < wheelLevels; i++ {
+		shift := uint(wheelBits0 + (i+1)*wheelBitsN)
+		if idx < 1<<shift || i == wheelLevels-1 {
+			return &w.levels[i][(e>>(shift-wheelBitsN))&wheelMaskN]
+		}
+	}
+	panic("bug")
+}
+
+func (w *wheel) add(t *Timer) {
+	head := w.slot(t)
+	t.prev = head.prev
+	t.next = head
+	head.prev.next = t
+	head.prev = t
+}
+
+// the empty slots of the first level from index to the end of the turn
+func (w *wheel) skip(index uint64) uint64 {
+	for i := index; i < wheelSize0; i = (i | 63) + 1 {
+		word := w.bitmap[i>>6] >> (i & 63)
+		if word != 0 {
+			return i + uint64(bits.TrailingZeros64(word)) - index
+		}
+	}
+	return wheelSize0 - index
+}
+
+// the ticks of d from now, at least one
+func (w *wheel) schedule(t *Timer, now time.Time, d time.Duration) {
+	if w.start.IsZero() {
+		w.start = now
+	}
+
+	n := now.Add(d).Sub(w.start)
+	e := uint64(0)
+	if n > 0 {
+		e = uint64((n + w.tick - 1) / w.tick)
+	}
+	t.expires = e
+	w.add(t)
+}
+
+// move the timers of a slot of a level to the levels below, it returns the
+// index of the slot
+func (w *wheel) cascade(level int) int {
+	index := int((w.cur >> uint(wheelBits0+level*wheelBitsN)) & wheelMaskN)
+	head := &w.levels[level][index]
+	for head.next != head {
+		t := head.next
+		t.unlink()
+		w.add(t)
+	}
+	return index
+}
+
+// advance runs the timers up to now
+func (w *wheel) advance(now time.Time) {
+	if w.start.IsZero() {
+		w.start = now
+	}
+	if now.Before(w.start) {
+		return
+	}
+	target := uint64(now.Sub(w.start) / w.tick)
+
+	var expired Timer
+	expired.init()
+	for w.cur <= target {
+		index := w.cur & wheelMask0
+		if index == 0 {
+			for level := 0; level < wheelLevels && w.cascade(level) == 0; level++ {
+			}
+		}
+		if n := w.skip(index); n > 0 {
+			if n > target+1-w.cur {
+				n = target + 1 - w.cur
+			}
+			w.cur += n
+			continue
+		}
+		w.cur++
+
+		// the timers added by the callbacks go to the next ticks
+		w.bitmap[index>>6] &^= 1 << (index & 63)
+		head := &w.level0[index]
+		if head.next == head {
+			continue
+		}
+		expired.next, expired.prev = head.next, head.prev
+		expired.next.prev = &expired
+		expired.prev.next = &expired
+		head.init()
+
+		for expired.next != &expired {
+			t := expired.next
+			t.unlink()
+			if t.when.After(now) {
+				// clamped by slot
+				w.schedule(t, now, t.when.Sub(now))
+				continue
+			}
+			t.Cb()
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package timer_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/rufeng18/tinyleaf/timer"
+)
+
+func TestWheel(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := timer.NewFakeClock(start)
+	d := timer.NewWheelDispatcher(time.Millisecond)
+	d.SetClock(clock)
+
+	type entry struct {
+		due     time.Time
+		fired   time.Time
+		stopped bool
+	}
+	r := rand.New(rand.NewSource(1))
+	var entries []*entry
+	var timers []*timer.Timer
+	var add func(delay time.Duration)
+	add = func(delay time.Duration) {
+		e := &entry{due: clock.Now().Add(delay)}
+		entries = append(entries, e)
+		timers = append(timers, d.AfterFunc(delay, func() {
+			if !e.fired.IsZero() {
+				t.Fatalf("fired twice")
+			}
+			e.fired = clock.Now()
+			// a timer from a callback
+			if r.Intn(4) == 0 {
+				add(time.Duration(r.Int63n(int64(time.Minute))))
+			}
+		}))
+	}
+
+	// the levels cover 1<<8, 1<<14, 1<<20, 1<<26 ticks
+	for _, max := range []time.Duration{1 << 8, 1 << 14, 1 << 20, 1 << 26} {
+		for i := 0; i < 200; i++ {
+			add(time.Duration(r.Int63n(int64(max * time.Millisecond))))
+		}
+	}
+	for i := 0; i < 100; i++ {
+		j := r.Intn(len(timers))
+		timers[j].Stop()
+		entries[j].stopped = true
+	}
+
+	end := start.Add(1<<26*time.Millisecond + time.Hour)
+	for clock.Now().Before(end) {
+		clock.Advance(time.Duration(r.Int63n(int64(10 * time.Minute))))
+		d.Advance()
+	}
+
+	for i, e := range entries {
+		switch {
+		case e.stopped:
+			if !e.fired.IsZero() {
+				t.Fatalf("timer %v stopped but fired", i)
+			}
+		case e.fired.IsZero():
+			t.Fatalf("timer %v due %v not fired", i, e.due)
+		case e.fired.Before(e.due):
+			t.Fatalf("timer %v due %v fired early at %v", i, e.due, e.fired)
+		case e.fired.Sub(e.due) > 10*time.Minute+time.Millisecond:
+			t.Fatalf("timer %v due %v fired late at %v", i, e.due, e.fired)
+		}
+	}
+
+	// beyond the range of the wheel, 1<<32 ticks
+	var fired time.Time
+	due := clock.Now().Add(60 * 24 * time.Hour)
+	d.AfterFunc(due.Sub(clock.Now()), func() {
+		fired = clock.Now()
+	})
+	clock.Advance(50 * 24 * time.Hour)
+	d.Advance()
+	if !fired.IsZero() {
+		t.Fatalf("timer due %v fired early at %v", due, fired)
+	}
+	clock.Advance(10*24*time.Hour + time.Millisecond)
+	d.Advance()
+	if fired.IsZero() {
+		t.Fatalf("timer due %v not fired", due)
+	}
+}
+
+// a steady population of timers, each added and stopped or fired
+func benchmarkDispatcher(b *testing.B, d *timer.Dispatcher, dispatch func()) {
+	const population = 10000
+	timers := make([]*timer.Timer, population)
+	cb := func() {}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % population
+		if timers[j] != nil {
+			timers[j].Stop()
+		}
+		timers[j] = d.AfterFunc(time.Duration(j+1)*time.Millisecond, cb)
+		if j == 0 {
+			dispatch()
+		}
+	}
+	b.StopTimer()
+	for _, t := range timers {
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+func BenchmarkDispatcher(b *testing.B) {
+	d := timer.NewDispatcher(100000)
+	benchmarkDispatcher(b, d, func() {
+		for len(d.ChanTimer) > 0 {
+			t := <-d.ChanTimer
+			t.Cb()
+			t.Stop()
+		}
+	})
+}
+
+func BenchmarkWheelDispatcher(b *testing.B) {
+	d := timer.NewWheelDispatcher(time.Millisecond)
+	benchmarkDispatcher(b, d, d.Advance)
+}